@@ -0,0 +1,130 @@
+package persisted
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The key of the record holding a batch of operations. Each parameter of the
+// record is the payload of one operation in the batch, encoded in the file's
+// Format from a fresh encoding so that a batch can be decoded on its own.
+const batchKey = "__batch__"
+
+// AppendBatch records the given operations in the log as a single record, so
+// that Replay applies either all of them or, if the process died while the
+// record was being written, none of them. Operations in a batch are replayed,
+// migrated and counted exactly as if they had been appended one by one. As with
+// Append, an error means that none of the operations were recorded. A batch
+// of one operation is recorded just as Append would record it. The key
+// "__batch__" is reserved for batches.
+func (l *Log) AppendBatch(ops ...Operation) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkWritableLocked(); err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	batch := make([]marshalledOperation, len(ops))
+	for i, op := range ops {
+		if op.Key == batchKey {
+			return errors.New("Key <" + batchKey + "> is reserved for batches")
+		}
+		var err error
+		batch[i], err = op.marshal(l.codec)
+		if err != nil {
+			return err
+		}
+	}
+	record := marshalledOperation{Key: batchKey, batch: batch}
+	if len(batch) == 1 {
+		// A single operation is written in one record anyway.
+		record = batch[0]
+	}
+	err := l.write(record)
+	if err != nil {
+		return err
+	}
+	l.opsSinceCompaction += len(ops)
+	l.appended()
+	return nil
+}
+
+// Returns the batch of operations packed into a single operation, its
+// parameters encoded in the given format.
+func packBatch(format Format, batch []marshalledOperation) (marshalledOperation, error) {
+	encoding := newRecordEncoding(format)
+	params := make([][]byte, len(batch))
+	for i, op := range batch {
+		payload, err := encoding.encode(op)
+		if err != nil {
+			return marshalledOperation{}, err
+		}
+		encoding.commit(op)
+		params[i] = payload
+	}
+	return marshalledOperation{Key: batchKey, MarshalledParameters: params}, nil
+}
+
+// Returns the operations packed into a batch read from a file in the given
+// format.
+func unpackBatch(format Format, batchOp marshalledOperation) ([]marshalledOperation, error) {
+	encoding := newRecordEncoding(format)
+	batch := make([]marshalledOperation, len(batchOp.MarshalledParameters))
+	for i, payload := range batchOp.MarshalledParameters {
+		op, err := encoding.decode(payload)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d of batch: %v", i, err)
+		}
+		if op.Key == batchKey {
+			return nil, fmt.Errorf("operation %d of batch is itself a batch", i)
+		}
+		batch[i] = op
+	}
+	return batch, nil
+}
+
+// The changes made in a transaction, such as the one passed to
+// LinkedList.Batch, shared by the views of each structure it touches.
+type transaction struct {
+	// The operations to record, and the functions undoing each change, in the
+	// order they were made.
+	ops  []Operation
+	undo []func()
+	done bool
+}
+
+// Calls fn, which makes changes in the transaction, then records them in the
+// log as a batch. If fn fails or panics, or the batch cannot be written, the
+// changes are rolled back.
+func (t *transaction) run(log *Log, fn func() error) error {
+	committed := false
+	defer func() {
+		t.done = true
+		if !committed {
+			t.rollback()
+		}
+	}()
+	err := fn()
+	if err == nil {
+		err = log.AppendBatch(t.ops...)
+	}
+	committed = err == nil
+	return err
+}
+
+// Records a change made in the transaction, along with the function undoing it.
+func (t *transaction) record(undo func(), key string, params ...interface{}) {
+	t.ops = append(t.ops, NewOperation(key, params...))
+	t.undo = append(t.undo, undo)
+}
+
+// Undoes the changes made in the transaction, most recent first.
+func (t *transaction) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+	t.ops = nil
+	t.undo = nil
+}
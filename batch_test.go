@@ -0,0 +1,247 @@
+package persisted
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Returns the path of a new, empty file to anchor a structure to.
+func newLogFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "log")
+	err := ioutil.WriteFile(path, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBatch(t *testing.T) {
+	for _, format := range []Format{FormatJSON, FormatBinary} {
+		t.Run(format.String(), func(t *testing.T) {
+			path := newLogFile(t)
+			opts := []Option{WithFormat(format), WithCompactionPolicy(CompactManually)}
+			ll, err := NewLinkedList[int](path, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ll.Append(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ll.Batch(func(tx *ListTx[int]) error {
+				for i := 1; i <= 3; i++ {
+					if err := tx.Append(i); err != nil {
+						return err
+					}
+				}
+				popped, err := tx.Pop()
+				if err != nil {
+					return err
+				}
+				return tx.Push(popped)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []int{3, 0, 1, 2}
+			if got := getIntegerSlice(ll); !reflect.DeepEqual(got, expected) {
+				t.Fatalf("Expected %v after batch; got %v", expected, got)
+			}
+
+			// A batch which fails changes nothing, in memory or on disk.
+			sizeBefore := size(ll.log.file)
+			errFailed := errors.New("failed")
+			err = ll.Batch(func(tx *ListTx[int]) error {
+				tx.Append(4)
+				tx.Pop()
+				tx.Pop()
+				tx.Push(5)
+				return errFailed
+			})
+			if err != errFailed {
+				t.Fatalf("Expected the batch's error; got %v", err)
+			}
+			if got := getIntegerSlice(ll); !reflect.DeepEqual(got, expected) {
+				t.Fatalf("Expected %v after failed batch; got %v", expected, got)
+			}
+			if size(ll.log.file) != sizeBefore {
+				t.Fatal("Failed batch was written to the log")
+			}
+			func() {
+				defer func() { recover() }()
+				ll.Batch(func(tx *ListTx[int]) error {
+					tx.Pop()
+					panic("in batch")
+				})
+			}()
+			if got := getIntegerSlice(ll); !reflect.DeepEqual(got, expected) {
+				t.Fatalf("Expected %v after panicking batch; got %v", expected, got)
+			}
+
+			err = ll.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ll, err = NewLinkedList[int](path, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ll.Close()
+			if got := getIntegerSlice(ll); !reflect.DeepEqual(got, expected) {
+				t.Fatalf("Expected %v after replay; got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestTornBatch(t *testing.T) {
+	path := newLogFile(t)
+	opts := []Option{WithCompactionPolicy(CompactManually)}
+	ll, err := NewLinkedList[int](path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ll.Append(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizeBefore := size(ll.log.file)
+	err = ll.Batch(func(tx *ListTx[int]) error {
+		for i := 1; i <= 10; i++ {
+			if err := tx.Append(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = ll.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the batch's record off partway through, as a crash mid-write would.
+	sizeAfter, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path, (sizeBefore+sizeAfter.Size())/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll, err = NewLinkedList[int](path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ll.Close()
+	if got := getIntegerSlice(ll); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("Expected none of the torn batch to be applied; got %v", got)
+	}
+	if ll.log.Discarded() == 0 {
+		t.Fatal("Expected the torn batch to be discarded")
+	}
+}
+
+func TestBatchDuringBackgroundCompaction(t *testing.T) {
+	path := newLogFile(t)
+	opts := []Option{WithFormat(FormatBinary), WithCompactionPolicy(CompactEvery(50))}
+	ll, err := NewLinkedList[int](path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = ll.Batch(func(tx *ListTx[int]) error {
+			if err := tx.Append(2 * i); err != nil {
+				return err
+			}
+			return tx.Append(2*i + 1)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll, err = NewLinkedList[int](path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ll.Close()
+	ints := getIntegerSlice(ll)
+	if len(ints) != 200 {
+		t.Fatalf("Expected 200 elements; got %d", len(ints))
+	}
+	for i, n := range ints {
+		if n != i {
+			t.Fatalf("Expected %d at position %d; got %d", i, i, n)
+		}
+	}
+}
+
+// Each change a ListTx can make should be replayed, and undone by a rollback.
+func TestBatchPositional(t *testing.T) {
+	path := newLogFile(t)
+	opts := []Option{WithCompactionPolicy(CompactManually)}
+	ll, err := NewLinkedList[int](path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		err = ll.Append(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes := func(tx *ListTx[int]) error {
+		if _, err := tx.Shift(); err != nil {
+			return err
+		}
+		if err := tx.InsertAt(2, 10); err != nil {
+			return err
+		}
+		if _, err := tx.RemoveAt(0); err != nil {
+			return err
+		}
+		if err := tx.Set(1, 20); err != nil {
+			return err
+		}
+		saved, _ := tx.Get(3)
+		if err := tx.Clear(); err != nil {
+			return err
+		}
+		return tx.Append(saved)
+	}
+	errFailed := errors.New("failed")
+	err = ll.Batch(func(tx *ListTx[int]) error {
+		if err := changes(tx); err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("Expected the batch's error; got %v", err)
+	}
+	checkInts(t, ll, []int{0, 1, 2, 3, 4})
+
+	err = ll.Batch(changes)
+	if err == nil {
+		err = ll.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInts(t, ll, []int{4})
+	ll, err = NewLinkedList[int](path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ll.Close()
+	checkInts(t, ll, []int{4})
+}
@@ -0,0 +1,69 @@
+package persisted
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec marshals and unmarshals the parameters of logged operations. A
+// "round-tripped" parameter (one which has been marshalled, then unmarshalled
+// into a value of the original type) must be equivalent to its original self.
+//
+// The codec's name is used to identify it, so it must be unique and must not
+// change once data has been written with it.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON encodes parameters using encoding/json. This is the default codec.
+	JSON Codec = jsonCodec{}
+	// Gob encodes parameters using encoding/gob. Each parameter is encoded on its
+	// own, so types do not need to be registered unless they are stored in
+	// interface values.
+	Gob Codec = gobCodec{}
+)
+
+// WithCodec sets the codec used for operation parameters. The default is JSON.
+// Data written with one codec must be read back with the same one.
+func WithCodec(codec Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
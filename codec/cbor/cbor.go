@@ -0,0 +1,26 @@
+// Package cbor provides a persisted.Codec which encodes operation parameters
+// as CBOR (RFC 8949).
+package cbor
+
+import (
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hwh33/persisted"
+)
+
+// Codec encodes parameters using github.com/fxamacker/cbor/v2. Pass it to
+// persisted.WithCodec.
+var Codec persisted.Codec = codec{}
+
+type codec struct{}
+
+func (codec) Name() string {
+	return "cbor"
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
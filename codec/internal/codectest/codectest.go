@@ -0,0 +1,60 @@
+// Package codectest holds the tests shared by the codecs in the packages under
+// codec.
+package codectest
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hwh33/persisted"
+)
+
+// Element is a struct with the kinds of fields codecs tend to differ on.
+type Element struct {
+	Name  string
+	Count uint64
+	Tags  []string
+}
+
+// RoundTrip checks that elements written to a LinkedList with the codec are
+// read back identically once the list is reopened.
+func RoundTrip(t *testing.T, codec persisted.Codec) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "log")
+	err := os.WriteFile(path, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll, err := persisted.NewLinkedList[Element](path, persisted.WithCodec(codec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	elements := []Element{{"a", 1, []string{"x"}}, {"b", 1 << 60, nil}}
+	for _, e := range elements {
+		err = ll.Append(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	llJr, err := persisted.NewLinkedList[Element](path, persisted.WithCodec(codec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llJr.Close()
+	if llJr.Length() != len(elements) {
+		t.Fatalf("Expected %d elements; got %d", len(elements), llJr.Length())
+	}
+	for i, e := range elements {
+		got, _ := llJr.Get(i)
+		if got.Name != e.Name || got.Count != e.Count || !reflect.DeepEqual(got.Tags, e.Tags) {
+			t.Errorf("Element %d not equal. Original: %v Loaded: %v", i, e, got)
+		}
+	}
+}
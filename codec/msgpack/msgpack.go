@@ -0,0 +1,26 @@
+// Package msgpack provides a persisted.Codec which encodes operation
+// parameters as MessagePack.
+package msgpack
+
+import (
+	"github.com/hwh33/persisted"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes parameters using github.com/vmihailenco/msgpack/v5. Pass it to
+// persisted.WithCodec.
+var Codec persisted.Codec = codec{}
+
+type codec struct{}
+
+func (codec) Name() string {
+	return "msgpack"
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
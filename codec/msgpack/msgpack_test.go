@@ -0,0 +1,11 @@
+package msgpack
+
+import (
+	"testing"
+
+	"github.com/hwh33/persisted/codec/internal/codectest"
+)
+
+func TestRoundtrip(t *testing.T) {
+	codectest.RoundTrip(t, Codec)
+}
@@ -0,0 +1,57 @@
+// Package protobuf provides a persisted.Codec which encodes protocol buffer
+// messages in their binary wire format.
+package protobuf
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/hwh33/persisted"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes parameters which are protocol buffer messages using
+// google.golang.org/protobuf/proto. Pass it to persisted.WithCodec.
+//
+// The persisted structures record some parameters of their own, such as
+// positions and IDs, which are not messages. These, and any other parameter
+// which is not a message, are encoded as JSON. Whether a parameter is treated
+// as a message is decided by its type, so a value always decodes the same way
+// it was encoded.
+var Codec persisted.Codec = codec{}
+
+type codec struct{}
+
+var messageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+func (codec) Name() string {
+	return "protobuf"
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+	return json.Marshal(v)
+}
+
+// Unmarshal accepts either a message or a pointer to a message pointer, which
+// is what a structure with messages as elements decodes into. In the latter
+// case a new message is allocated.
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() == reflect.Ptr && ptr.Type().Elem().Implements(messageType) &&
+		ptr.Type().Elem().Kind() == reflect.Ptr {
+		m := reflect.New(ptr.Type().Elem().Elem())
+		err := proto.Unmarshal(data, m.Interface().(proto.Message))
+		if err != nil {
+			return err
+		}
+		ptr.Elem().Set(m)
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,54 @@
+package protobuf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hwh33/persisted"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Messages written with the codec should be read back identically, alongside
+// the non-message parameters recorded by the structures themselves.
+func TestRoundtrip(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "temp-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer os.Remove(tempFile.Name() + ".lock")
+	tempFile.Close()
+
+	q, err := persisted.NewQueue[*wrapperspb.StringValue](tempFile.Name(), persisted.WithCodec(Codec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []string{"a", "b", "c"}
+	for _, v := range values {
+		err = q.Enqueue(wrapperspb.String(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = q.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qJr, err := persisted.NewQueue[*wrapperspb.StringValue](tempFile.Name(), persisted.WithCodec(Codec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qJr.Close()
+	for _, v := range values {
+		lease, err := qJr.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(lease.Value, wrapperspb.String(v)) {
+			t.Errorf("Expected %q; got %v", v, lease.Value)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package persisted
+
+import (
+	"os"
+	"time"
+)
+
+// CompactionPolicy decides when a Log compacts itself. It is consulted after
+// every append. Compaction can also be triggered explicitly with Compact,
+// whatever the policy.
+type CompactionPolicy interface {
+	ShouldCompact(stats CompactionStats) bool
+}
+
+// CompactionStats describes a log's growth since it was last compacted, or
+// since it was opened if it hasn't been compacted since.
+type CompactionStats struct {
+	// The size of the log, in bytes.
+	Size int64
+	// The size of the log just after it was last compacted: an estimate of the
+	// size of the live data.
+	LiveSize int64
+	// The number of operations appended.
+	Ops int
+	// How long it has been.
+	Elapsed time.Duration
+	// The number of compactions which have failed since the last one which
+	// succeeded. Failed compactions are retried whenever the policy calls for
+	// compaction, so a policy may use this to back off.
+	Failures int
+}
+
+type compactionPolicyFunc func(CompactionStats) bool
+
+func (f compactionPolicyFunc) ShouldCompact(stats CompactionStats) bool {
+	return f(stats)
+}
+
+// CompactManually never compacts the log of its own accord; see Compact.
+var CompactManually CompactionPolicy = compactionPolicyFunc(func(CompactionStats) bool {
+	return false
+})
+
+// CompactAtSize compacts the log whenever it is larger than the given number of
+// bytes. If the live data alone is larger than that, the log is compacted after
+// every append.
+func CompactAtSize(bytes int64) CompactionPolicy {
+	return compactionPolicyFunc(func(stats CompactionStats) bool {
+		return stats.Size > bytes
+	})
+}
+
+// CompactAtRatio compacts the log once it is more than ratio times the size it
+// was after the last compaction, provided it is larger than minSize bytes. This
+// keeps the cost of compaction in proportion to the amount of garbage it
+// removes. The default policy is CompactAtRatio(2, 10*1024).
+func CompactAtRatio(ratio float64, minSize int64) CompactionPolicy {
+	return compactionPolicyFunc(func(stats CompactionStats) bool {
+		return stats.Size > minSize && float64(stats.Size) > ratio*float64(stats.LiveSize)
+	})
+}
+
+// CompactEvery compacts the log after every n appends.
+func CompactEvery(n int) CompactionPolicy {
+	if n < 1 {
+		n = 1
+	}
+	return compactionPolicyFunc(func(stats CompactionStats) bool {
+		return stats.Ops >= n
+	})
+}
+
+// CompactInterval compacts the log on the first append at least d after the
+// last compaction.
+func CompactInterval(d time.Duration) CompactionPolicy {
+	return compactionPolicyFunc(func(stats CompactionStats) bool {
+		return stats.Ops > 0 && stats.Elapsed >= d
+	})
+}
+
+// WithCompactionPolicy sets the policy which decides when the log is compacted.
+// The default is CompactAtRatio(2, 10*1024).
+func WithCompactionPolicy(policy CompactionPolicy) Option {
+	return func(o *options) {
+		o.compaction = policy
+	}
+}
+
+// Compact compacts the log now, whatever its CompactionPolicy, and returns once
+// the compacted log is in place. Like Append, this calls the SnapshotFunc, so
+// it must not run concurrently with changes to the structure. A log without a
+// SnapshotFunc is never compacted.
+func (l *Log) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkWritableLocked(); err != nil {
+		return err
+	}
+	return l.compact()
+}
+
+// Returns the log's growth since it was last compacted. l.mu must be held.
+func (l *Log) compactionStats() (CompactionStats, error) {
+	stat, err := l.file.Stat()
+	if err != nil {
+		return CompactionStats{}, err
+	}
+	size := stat.Size()
+	if l.snapshots || l.segmentSize > 0 {
+		// The snapshot and any sealed segments are part of the log too.
+		size += l.liveSize + l.sealedSize
+	}
+	return CompactionStats{
+		Size:     size,
+		LiveSize: l.liveSize,
+		Ops:      l.opsSinceCompaction,
+		Elapsed:  time.Since(l.lastCompaction),
+		Failures: l.compactionFailures,
+	}, nil
+}
+
+// Records that the log has just been compacted down to liveSize bytes. l.mu
+// must be held.
+func (l *Log) compacted(liveSize int64) {
+	l.liveSize = liveSize
+	l.opsSinceCompaction = 0
+	l.lastCompaction = time.Now()
+}
+
+// A compaction running in the background. Appends carry on into the current
+// log file while the compacted file is written, and are also kept in a side
+// buffer. Once the compacted file is written, the buffered operations are
+// spliced onto its end and it replaces the log file.
+type backgroundCompaction struct {
+	// Closed once the goroutine writing the compacted file has finished, after
+	// setting the fields below.
+	done chan struct{}
+	// The compacted file, still under its temporary name, and the state of its
+	// encoding after the last operation written to it.
+	file     *os.File
+	header   fileHeader
+	encoding recordEncoding
+	err      error
+	// The operations appended since the snapshot was taken, and the size of
+	// their records. Guarded by l.mu.
+	buffered     []marshalledOperation
+	bufferedSize int64
+	started      time.Time
+}
+
+// Takes a snapshot and starts writing it to a new file in the background. l.mu
+// must be held, so that the snapshot is consistent with the log.
+func (l *Log) startCompaction() {
+	ops := l.liveOperations()
+	c := &backgroundCompaction{
+		done:    make(chan struct{}),
+		header:  l.newHeader(0),
+		started: l.compactionStarted(true),
+	}
+	l.compaction = c
+	path := l.file.Name()
+	go func() {
+		defer close(c.done)
+		info, err := os.Stat(path)
+		if err == nil {
+			c.file, err = createTempFile(path, info.Mode().Perm())
+		}
+		if err == nil {
+			c.encoding, err = l.writeOperations(c.file, &c.header, ops)
+			if err != nil {
+				discardTempFile(c.file)
+			}
+		}
+		c.err = err
+	}()
+}
+
+// Finishes the background compaction, if there is one, by splicing the
+// buffered operations onto the compacted file and swapping it in. If wait is
+// false and the compacted file is still being written, this does nothing.
+// l.mu must be held.
+func (l *Log) finishCompaction(wait bool) error {
+	c := l.compaction
+	if c == nil {
+		return nil
+	}
+	if wait {
+		<-c.done
+	} else {
+		select {
+		case <-c.done:
+		default:
+			return nil
+		}
+	}
+	l.compaction = nil
+	err := l.swapCompacted(c)
+	l.compactionFinished(c.started, err)
+	return err
+}
+
+// Swaps in the file written by a finished background compaction. l.mu must be
+// held.
+func (l *Log) swapCompacted(c *backgroundCompaction) error {
+	if c.err != nil {
+		return c.err
+	}
+	err := l.splice(c)
+	if err != nil {
+		discardTempFile(c.file)
+		return err
+	}
+	err = l.reopen(c.header, c.encoding)
+	if err != nil {
+		return err
+	}
+	// Appends made since the snapshot count towards the next compaction.
+	stat, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	l.liveSize = stat.Size() - c.bufferedSize
+	l.opsSinceCompaction = len(c.buffered)
+	l.lastCompaction = c.started
+	return nil
+}
+
+// Writes the buffered operations to the end of the compacted file and renames
+// it over the log file. l.mu must be held.
+func (l *Log) splice(c *backgroundCompaction) error {
+	for _, marshalledOp := range c.buffered {
+		record, err := encodeRecord(c.encoding, marshalledOp)
+		if err != nil {
+			return err
+		}
+		_, err = c.file.Write(record)
+		if err != nil {
+			return err
+		}
+		c.encoding.commit(marshalledOp)
+		c.bufferedSize += int64(len(record))
+	}
+	return commitTempFile(c.file, l.file.Name())
+}
+
+// Stops waiting for the background compaction, if there is one, and throws
+// away its file. l.mu must be held.
+func (l *Log) abandonCompaction() {
+	c := l.compaction
+	if c == nil {
+		return
+	}
+	<-c.done
+	l.compaction = nil
+	l.logger.Debug("compaction abandoned")
+	if c.err == nil {
+		discardTempFile(c.file)
+	}
+}
+
+// Logs the start of a compaction and returns the time it started. l.mu must be
+// held.
+func (l *Log) compactionStarted(background bool) time.Time {
+	l.logger.Info("compaction started", "background", background)
+	return time.Now()
+}
+
+// Logs the end of a compaction which started at start, and counts it if it
+// failed. l.mu must be held.
+func (l *Log) compactionFinished(start time.Time, err error) {
+	if err != nil {
+		l.compactionFailures++
+		l.logger.Error("compaction failed", "error", err, "failures", l.compactionFailures,
+			"duration", time.Since(start))
+		return
+	}
+	l.compactionFailures = 0
+	l.logger.Info("compaction finished", "size", l.liveSize, "duration", time.Since(start))
+}
@@ -0,0 +1,270 @@
+package persisted
+
+import (
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+)
+
+// Operations appended while a compaction is running in the background should
+// be in the log file which replaces the old one.
+func TestBackgroundCompaction(t *testing.T) {
+	var s []int
+	callback := func() []Operation {
+		ops := make([]Operation, len(s))
+		for index, i := range s {
+			ops[index] = NewOperation(appendKey, i)
+		}
+		return ops
+	}
+	for _, format := range []Format{FormatJSON, FormatBinary} {
+		t.Run(format.String(), func(t *testing.T) {
+			tf, err := ioutil.TempFile("", "temp-testing")
+			defer removeLogFiles(tf.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			s = nil
+			l, err := NewLog(tf.Name(), callback, WithFormat(format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			l.compactionPolicy = CompactManually
+			for i := 0; i < 100; i++ {
+				s = append(s, i)
+				err = l.Append(appendKey, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s = s[1:]
+				err = l.Append(deleteKey, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			l.mu.Lock()
+			l.startCompaction()
+			c := l.compaction
+			l.mu.Unlock()
+			// Let the compacted file be written, so that the next append finishes the
+			// compaction after adding its operation to the buffer.
+			<-c.done
+			sizeBefore := size(l.file)
+			s = append(s, 100)
+			err = l.Append(appendKey, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(c.buffered) != 1 || l.compaction != nil {
+				t.Fatalf("Expected the compaction to finish with 1 buffered operation; buffered %d", len(c.buffered))
+			}
+			if size(l.file) >= sizeBefore {
+				t.Fatalf("Compaction did not shrink the log file from %d bytes", sizeBefore)
+			}
+
+			var replayed []int
+			err = l.Replay(map[string]Handler{
+				appendKey: appendOperation(&replayed),
+				deleteKey: deleteOperation(&replayed),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slicesEqual(replayed, []int{100}) {
+				t.Fatalf("Replayed %v after compaction", replayed)
+			}
+		})
+	}
+}
+
+func TestCompactionPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   CompactionPolicy
+		stats    CompactionStats
+		expected bool
+	}{
+		{"manual", CompactManually, CompactionStats{Size: 1 << 30, Ops: 1 << 20, Elapsed: time.Hour}, false},
+		{"under size", CompactAtSize(100), CompactionStats{Size: 100}, false},
+		{"over size", CompactAtSize(100), CompactionStats{Size: 101}, true},
+		{"under ratio", CompactAtRatio(2, 10), CompactionStats{Size: 200, LiveSize: 100}, false},
+		{"over ratio", CompactAtRatio(2, 10), CompactionStats{Size: 201, LiveSize: 100}, true},
+		{"over ratio under minimum", CompactAtRatio(2, 1000), CompactionStats{Size: 201, LiveSize: 100}, false},
+		{"under ops", CompactEvery(10), CompactionStats{Ops: 9}, false},
+		{"at ops", CompactEvery(10), CompactionStats{Ops: 10}, true},
+		{"under interval", CompactInterval(time.Minute), CompactionStats{Ops: 1, Elapsed: time.Second}, false},
+		{"over interval", CompactInterval(time.Minute), CompactionStats{Ops: 1, Elapsed: time.Hour}, true},
+		{"over interval without ops", CompactInterval(time.Minute), CompactionStats{Elapsed: time.Hour}, false},
+	}
+	for _, tc := range tests {
+		if tc.policy.ShouldCompact(tc.stats) != tc.expected {
+			t.Errorf("%s: expected ShouldCompact(%+v) to be %t", tc.name, tc.stats, tc.expected)
+		}
+	}
+}
+
+// Compact should compact whatever the policy, and the policy should see the
+// log's growth since.
+func TestManualCompaction(t *testing.T) {
+	ll, wipeTempFiles, err := createTemporaryLinkedList[integer]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wipeTempFiles()
+	ll.log.compactionPolicy = CompactManually
+	for i := 0; i < 100; i++ {
+		err = ll.Push(integer{i})
+		if err == nil {
+			_, err = ll.Pop()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ll.Append(integer{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizeBefore := size(ll.log.file)
+	err = ll.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size(ll.log.file) >= sizeBefore {
+		t.Fatalf("Compact did not shrink the log from %d bytes", sizeBefore)
+	}
+
+	ll.log.mu.Lock()
+	stats, err := ll.log.compactionStats()
+	ll.log.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Ops != 0 || stats.Size != stats.LiveSize || stats.Size != size(ll.log.file) {
+		t.Fatalf("Unexpected stats after compaction: %+v", stats)
+	}
+	err = ll.Append(integer{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll.log.mu.Lock()
+	stats, err = ll.log.compactionStats()
+	ll.log.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Ops != 1 || stats.Size <= stats.LiveSize {
+		t.Fatalf("Unexpected stats after an append: %+v", stats)
+	}
+}
+
+// A background compaction which fails should be counted and retried, not
+// reported by the appends which happen to find it has finished.
+func TestFailedBackgroundCompaction(t *testing.T) {
+	var s []int
+	fail := true
+	callback := func() []Operation {
+		if fail {
+			return []Operation{NewOperation(appendKey, math.NaN())}
+		}
+		ops := make([]Operation, len(s))
+		for index, i := range s {
+			ops[index] = NewOperation(appendKey, i)
+		}
+		return ops
+	}
+	path := newLogFile(t)
+	l, err := NewLog(path, callback, WithCompactionPolicy(CompactManually))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	compactThenAppend := func(i int) CompactionStats {
+		l.mu.Lock()
+		l.startCompaction()
+		c := l.compaction
+		l.mu.Unlock()
+		<-c.done
+		s = append(s, i)
+		err := l.Append(appendKey, i)
+		if err != nil {
+			t.Fatalf("Append returned the compaction's error: %v", err)
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.compaction != nil {
+			t.Fatal("Expected the append to finish the compaction")
+		}
+		stats, err := l.compactionStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	if stats := compactThenAppend(0); stats.Failures != 1 {
+		t.Fatalf("Expected 1 failed compaction; got %d", stats.Failures)
+	}
+	fail = false
+	if stats := compactThenAppend(1); stats.Failures != 0 {
+		t.Fatalf("Expected the failures to be cleared by a successful compaction; got %d", stats.Failures)
+	}
+	var replayed []int
+	err = l.Replay(map[string]Handler{appendKey: appendOperation(&replayed)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slicesEqual(replayed, s) {
+		t.Fatalf("Replayed %v; expected %v", replayed, s)
+	}
+}
+
+// Replay should only compact the log if the CompactionPolicy says so.
+func TestCompactionOnReplay(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    CompactionPolicy
+		compacted bool
+	}{
+		{"manual", CompactManually, false},
+		{"under ops", CompactEvery(1000), false},
+		{"at ops", CompactEvery(200), true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := newLogFile(t)
+			ll, err := NewLinkedList[int](path, WithCompactionPolicy(CompactManually))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				err = ll.Push(i)
+				if err == nil {
+					_, err = ll.Pop()
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			sizeBefore := size(ll.log.file)
+			err = ll.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ll, err = NewLinkedList[int](path, WithCompactionPolicy(tc.policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ll.Close()
+			sizeAfter := size(ll.log.file)
+			if compacted := sizeAfter < sizeBefore; compacted != tc.compacted {
+				t.Fatalf("Expected compaction on replay to be %t; the log went from %d to %d bytes",
+					tc.compacted, sizeBefore, sizeAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package persisted
+
+import "time"
+
+// SyncPolicy determines when a Log calls fsync on its file. Until a write is
+// synced, an acknowledged operation may be lost if the machine loses power.
+// Syncing more often is safer but slower.
+type SyncPolicy struct {
+	// Sync after this many appends. Zero means never sync on append.
+	ops int
+	// Sync this often from a background goroutine. Zero means no background
+	// syncing.
+	interval time.Duration
+}
+
+var (
+	// SyncAlways syncs after every append, before Append returns.
+	SyncAlways = SyncPolicy{ops: 1}
+	// SyncNever leaves flushing to the operating system. Sync may still be called
+	// explicitly.
+	SyncNever = SyncPolicy{}
+)
+
+// SyncEvery syncs after every n appends, before the nth Append returns.
+func SyncEvery(n int) SyncPolicy {
+	if n < 1 {
+		n = 1
+	}
+	return SyncPolicy{ops: n}
+}
+
+// SyncInterval syncs in the background every d, provided something has been
+// appended since the last sync. Appends return without waiting for the sync.
+func SyncInterval(d time.Duration) SyncPolicy {
+	return SyncPolicy{interval: d}
+}
+
+// Syncs in the background according to l.syncPolicy until l.done is closed.
+func (l *Log) syncPeriodically() {
+	ticker := time.NewTicker(l.syncPolicy.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			if !l.closed && l.unsynced > 0 {
+				// Once a sync has failed the writes it was for may be gone, so a
+				// later sync which succeeds must not hide the failure.
+				if err := l.syncLocked(); err != nil {
+					l.logger.Error("background sync failed", "error", err)
+					if l.syncErr == nil {
+						l.syncErr = err
+					}
+				}
+			}
+			l.mu.Unlock()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Flushes the log file to stable storage. l.mu must be held.
+func (l *Log) syncLocked() error {
+	err := l.file.Sync()
+	if err != nil {
+		return err
+	}
+	l.unsynced = 0
+	return nil
+}
+
+// Called after each append to sync if the policy says we should. l.mu must be
+// held.
+func (l *Log) syncIfNecessary() error {
+	l.unsynced++
+	if l.syncPolicy.ops > 0 && l.unsynced >= l.syncPolicy.ops {
+		return l.syncLocked()
+	}
+	return nil
+}
+
+// Sync flushes every operation appended so far to stable storage, regardless
+// of the log's SyncPolicy. It also reports the first error from a background
+// sync since the last call, even if later background syncs succeeded.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkWritableLocked(); err != nil {
+		return err
+	}
+	err := l.syncErr
+	l.syncErr = nil
+	if err != nil {
+		return err
+	}
+	return l.syncLocked()
+}
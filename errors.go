@@ -0,0 +1,39 @@
+package persisted
+
+import "errors"
+
+// ErrCorrupt is returned when a log file contains damaged data which cannot be
+// explained by an interrupted write.
+var ErrCorrupt = errors.New("persisted: log file is corrupt")
+
+// ErrClosed is returned when modifying a structure, or its log, after it has
+// been closed.
+var ErrClosed = errors.New("persisted: closed")
+
+// ErrEmpty is returned when removing an element from an empty structure.
+var ErrEmpty = errors.New("persisted: empty")
+
+// ErrUnknownLease is returned when acknowledging a lease which is not
+// outstanding, for example because it has already been acknowledged.
+var ErrUnknownLease = errors.New("persisted: unknown lease")
+
+// ErrLocked is returned when opening a log for writing while another Log, in
+// this process or another, has it open for writing.
+var ErrLocked = errors.New("persisted: log is locked by another writer")
+
+// ErrReadOnly is returned when modifying a structure, or its log, which was
+// opened with WithReadOnly.
+var ErrReadOnly = errors.New("persisted: opened read-only")
+
+// ErrIncompatible is returned when opening a log file which cannot be read as
+// requested: one written by a newer version of this package, with a different
+// codec, or holding a different type of structure.
+var ErrIncompatible = errors.New("persisted: incompatible log file")
+
+// ErrTxDone is returned when modifying a structure through a transaction after
+// the function it was passed to has returned.
+var ErrTxDone = errors.New("persisted: transaction has finished")
+
+// ErrOutOfRange is returned when a position passed to a structure is outside
+// the bounds of the structure.
+var ErrOutOfRange = errors.New("persisted: position out of range")
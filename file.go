@@ -0,0 +1,119 @@
+package persisted
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Returns the prefix used for temporary files created while rewriting the file
+// at path. Temporary files live in the same directory as the file they replace
+// so that the final rename never crosses filesystems, and are hidden so they
+// don't clutter directory listings.
+func tempFilePrefix(path string) string {
+	return "." + filepath.Base(path) + ".tmp-"
+}
+
+// Atomically replaces the file at path with one whose contents are produced by
+// write. The new file is written alongside the old, synced, and then renamed
+// over it; the directory is synced so that the rename itself is durable. The
+// file at path must already exist and its permissions are carried over. On
+// failure, the original file is left untouched and the temporary file removed.
+func replaceFile(path string, write func(*os.File) error) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, info.Mode().Perm(), write)
+}
+
+// Like replaceFile, but the file at path need not exist. The new file has the
+// given permissions.
+func writeFileAtomic(path string, perm os.FileMode, write func(*os.File) error) error {
+	tempFile, err := createTempFile(path, perm)
+	if err != nil {
+		return err
+	}
+	err = write(tempFile)
+	if err == nil {
+		err = commitTempFile(tempFile, path)
+	}
+	if err != nil {
+		discardTempFile(tempFile)
+	}
+	return err
+}
+
+// Creates a temporary file with the given permissions alongside path, to
+// replace it once written.
+func createTempFile(path string, perm os.FileMode) (*os.File, error) {
+	tempFile, err := os.CreateTemp(filepath.Dir(path), tempFilePrefix(path)+"*")
+	if err != nil {
+		return nil, err
+	}
+	err = tempFile.Chmod(perm)
+	if err != nil {
+		discardTempFile(tempFile)
+		return nil, err
+	}
+	return tempFile, nil
+}
+
+// Syncs and closes a temporary file created by createTempFile, then renames it
+// over path.
+func commitTempFile(tempFile *os.File, path string) error {
+	err := tempFile.Sync()
+	if err != nil {
+		return err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempFile.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Closes and removes a temporary file which will not be used.
+func discardTempFile(tempFile *os.File) {
+	tempFile.Close()
+	os.Remove(tempFile.Name())
+}
+
+// Flushes the directory entry changes (creations, renames, removals) in dir to
+// stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	closeErr := d.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Removes temporary files left behind by a replaceFile call which was
+// interrupted by a crash.
+func removeTempFiles(path string) error {
+	dir := filepath.Dir(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	prefix := tempFilePrefix(path)
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasPrefix(entry.Name(), prefix) {
+			err = os.Remove(filepath.Join(dir, entry.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
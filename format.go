@@ -0,0 +1,210 @@
+package persisted
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Format is the encoding of the records in a log file. This is separate from
+// the encoding of operation parameters, which is determined by the Codec.
+type Format byte
+
+const (
+	// FormatJSON encodes each record as a JSON object holding the operation key
+	// and base64-encoded parameters. This is the default.
+	FormatJSON Format = iota
+	// FormatBinary encodes each record as a varint operation key ID followed by
+	// varint-length-prefixed parameters. Each key is written out in full only
+	// the first time it appears in the file. This is considerably smaller and
+	// faster to replay than FormatJSON.
+	FormatBinary
+)
+
+// WithFormat sets the record format used for new log files. Existing files are
+// read in whichever format they were written in, and are converted to this
+// format the next time they are compacted. The default is FormatJSON.
+func WithFormat(format Format) Option {
+	return func(o *options) {
+		o.format = format
+	}
+}
+
+var formatNames = map[Format]string{
+	FormatJSON:   "json",
+	FormatBinary: "binary",
+}
+
+func (f Format) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Format(%d)", byte(f))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (f Format) MarshalText() ([]byte, error) {
+	if _, ok := formatNames[f]; !ok {
+		return nil, fmt.Errorf("Unknown log file format %d", byte(f))
+	}
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (f *Format) UnmarshalText(text []byte) error {
+	for format, name := range formatNames {
+		if name == string(text) {
+			*f = format
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown log file format %q", text)
+}
+
+// Converts marshalled operations to and from record payloads in a particular
+// format. An encoding may carry state from one record to the next, so a single
+// instance should be used for a single file, from its first record on.
+type recordEncoding interface {
+	// Returns the payload for the operation. Does not change the state of the
+	// encoding until commit is called.
+	encode(op marshalledOperation) ([]byte, error)
+	// Records that the payload for the operation was written to the file.
+	commit(op marshalledOperation)
+	// Decodes the next payload read from the file.
+	decode(payload []byte) (marshalledOperation, error)
+	// The format the encoding writes.
+	format() Format
+}
+
+func newRecordEncoding(format Format) recordEncoding {
+	if format == FormatBinary {
+		return &binaryEncoding{ids: make(map[string]uint64)}
+	}
+	return jsonEncoding{}
+}
+
+type jsonEncoding struct{}
+
+func (jsonEncoding) encode(op marshalledOperation) ([]byte, error) {
+	return json.Marshal(op)
+}
+
+func (jsonEncoding) commit(marshalledOperation) {}
+
+func (jsonEncoding) format() Format { return FormatJSON }
+
+func (jsonEncoding) decode(payload []byte) (op marshalledOperation, err error) {
+	err = json.Unmarshal(payload, &op)
+	return
+}
+
+// Binary payloads look like this, where each number is an unsigned varint:
+//
+//	key ID | [key length | key] | parameter count | (length | parameter)...
+//
+// Key IDs are assigned in order of first appearance, starting from 1. A key ID
+// of 0 means the key is new and is spelled out in full, taking the next ID.
+type binaryEncoding struct {
+	ids  map[string]uint64
+	keys []string
+}
+
+func (e *binaryEncoding) encode(op marshalledOperation) ([]byte, error) {
+	var payload []byte
+	if id, ok := e.ids[op.Key]; ok {
+		payload = binary.AppendUvarint(payload, id)
+	} else {
+		payload = binary.AppendUvarint(payload, 0)
+		payload = binary.AppendUvarint(payload, uint64(len(op.Key)))
+		payload = append(payload, op.Key...)
+	}
+	payload = binary.AppendUvarint(payload, uint64(len(op.MarshalledParameters)))
+	for _, param := range op.MarshalledParameters {
+		payload = binary.AppendUvarint(payload, uint64(len(param)))
+		payload = append(payload, param...)
+	}
+	return payload, nil
+}
+
+func (e *binaryEncoding) commit(op marshalledOperation) {
+	e.intern(op.Key)
+}
+
+func (*binaryEncoding) format() Format { return FormatBinary }
+
+func (e *binaryEncoding) intern(key string) {
+	if _, ok := e.ids[key]; !ok {
+		e.keys = append(e.keys, key)
+		e.ids[key] = uint64(len(e.keys))
+	}
+}
+
+var errShortPayload = errors.New("payload too short")
+
+func (e *binaryEncoding) decode(payload []byte) (op marshalledOperation, err error) {
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return 0, errShortPayload
+		}
+		payload = payload[n:]
+		return v, nil
+	}
+	bytes := func(length uint64) ([]byte, error) {
+		if uint64(len(payload)) < length {
+			return nil, errShortPayload
+		}
+		b := payload[:length:length]
+		payload = payload[length:]
+		return b, nil
+	}
+
+	id, err := next()
+	if err != nil {
+		return
+	}
+	if id == 0 {
+		var length uint64
+		length, err = next()
+		if err != nil {
+			return
+		}
+		var key []byte
+		key, err = bytes(length)
+		if err != nil {
+			return
+		}
+		op.Key = string(key)
+		e.intern(op.Key)
+	} else if id <= uint64(len(e.keys)) {
+		op.Key = e.keys[id-1]
+	} else {
+		return op, fmt.Errorf("undefined key ID %d", id)
+	}
+
+	count, err := next()
+	if err != nil {
+		return
+	}
+	if count > uint64(len(payload)) {
+		// Every parameter takes at least one byte for its length.
+		return op, errShortPayload
+	}
+	op.MarshalledParameters = make([][]byte, count)
+	for i := range op.MarshalledParameters {
+		var length uint64
+		length, err = next()
+		if err != nil {
+			return
+		}
+		op.MarshalledParameters[i], err = bytes(length)
+		if err != nil {
+			return
+		}
+	}
+	if len(payload) != 0 {
+		return op, fmt.Errorf("%d unexpected trailing bytes", len(payload))
+	}
+	return op, nil
+}
@@ -0,0 +1,202 @@
+package persisted
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+// The same operations should replay identically from either format, and the
+// binary format should be smaller.
+func TestFormats(t *testing.T) {
+	sizes := make(map[Format]int64)
+	for _, format := range []Format{FormatJSON, FormatBinary} {
+		t.Run(format.String(), func(t *testing.T) {
+			path := newLogFile(t)
+			l, err := NewLog(path, nil, WithFormat(format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected []int
+			for i := 0; i < 100; i++ {
+				expected = append(expected, i)
+				err = l.Append(appendKey, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i%10 == 0 {
+					expected = append(expected[:0], expected[1:]...)
+					err = l.Append(deleteKey, 0)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			sizes[format] = size(l.file)
+			err = l.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The format comes from the file, not the options.
+			l, err = NewLog(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			var s []int
+			err = l.Replay(map[string]Handler{
+				appendKey: appendOperation(&s),
+				deleteKey: deleteOperation(&s),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slicesEqual(s, expected) {
+				t.Fatalf("Replayed %v; expected %v", s, expected)
+			}
+		})
+	}
+	if sizes[FormatBinary] >= sizes[FormatJSON] {
+		t.Errorf("Binary log (%d bytes) should be smaller than JSON log (%d bytes)",
+			sizes[FormatBinary], sizes[FormatJSON])
+	}
+}
+
+// Logs written before records were framed hold one JSON operation per line
+// with no header. They should still be readable, and should be rewritten in
+// the configured format so that they can be appended to.
+func TestHeaderlessFile(t *testing.T) {
+	// As written by the log before the header existed, ending with a line cut
+	// short by a crash.
+	const (
+		lines = `{"Key":"append","MarshalledParameters":["MA=="]}
+{"Key":"append","MarshalledParameters":["MQ=="]}
+{"Key":"append","MarshalledParameters":["Mg=="]}
+`
+		torn = `{"Key":"append","Marshal`
+	)
+	for _, format := range []Format{FormatJSON, FormatBinary} {
+		t.Run(format.String(), func(t *testing.T) {
+			path := newLogFile(t)
+			err := ioutil.WriteFile(path, []byte(lines+torn), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var s []int
+			handlers := map[string]Handler{appendKey: appendOperation(&s)}
+			l, err := NewLog(path, nil, WithFormat(format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = l.Replay(handlers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slicesEqual(s, []int{0, 1, 2}) {
+				t.Fatalf("Replayed %v from headerless file", s)
+			}
+			if l.Discarded() != int64(len(torn)) {
+				t.Fatalf("Expected the incomplete line to be discarded; %d bytes were", l.Discarded())
+			}
+			header, err := readHeader(l.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.legacy() || header.Format != format {
+				t.Fatalf("Expected the file to be rewritten as %v; header is %+v", format, header)
+			}
+			err = l.Append(appendKey, 3)
+			if err == nil {
+				err = l.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s = nil
+			l, err = NewLog(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			err = l.Replay(handlers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slicesEqual(s, []int{0, 1, 2, 3}) {
+				t.Fatalf("Replayed %v from converted file", s)
+			}
+		})
+	}
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	writer := newRecordEncoding(FormatBinary)
+	ops := []marshalledOperation{
+		{Key: "first", MarshalledParameters: [][]byte{[]byte("a"), {}}},
+		{Key: "second"},
+		{Key: "first", MarshalledParameters: [][]byte{[]byte("b")}},
+	}
+	var payloads [][]byte
+	for _, op := range ops {
+		payload, err := writer.encode(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.commit(op)
+		payloads = append(payloads, payload)
+	}
+	// The key should only be spelled out the first time.
+	if len(payloads[2]) >= len(payloads[0]) {
+		t.Error("Repeated key should have been written as an ID")
+	}
+
+	reader := newRecordEncoding(FormatBinary)
+	for i, payload := range payloads {
+		op, err := reader.decode(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op.Key != ops[i].Key || len(op.MarshalledParameters) != len(ops[i].MarshalledParameters) {
+			t.Fatalf("Operation %d decoded as %v; expected %v", i, op, ops[i])
+		}
+		for j := range op.MarshalledParameters {
+			if string(op.MarshalledParameters[j]) != string(ops[i].MarshalledParameters[j]) {
+				t.Fatalf("Operation %d parameter %d decoded as %q", i, j, op.MarshalledParameters[j])
+			}
+		}
+	}
+
+	// A fresh reader hasn't seen the key definitions.
+	if _, err := newRecordEncoding(FormatBinary).decode(payloads[2]); err == nil {
+		t.Error("Expected error decoding undefined key ID")
+	}
+	// Nor should truncated payloads decode.
+	if _, err := newRecordEncoding(FormatBinary).decode(payloads[0][:len(payloads[0])-1]); err == nil {
+		t.Error("Expected error decoding truncated payload")
+	}
+}
+
+// A record which passes its checksum but can't be decoded is corruption.
+func TestUndecodableRecord(t *testing.T) {
+	l, err := NewLog(newLogFile(t), nil, WithFormat(FormatBinary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// Key ID 7 has never been defined.
+	record, err := frameRecord([]byte{7, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.file.Write(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Replay(map[string]Handler{})
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt; got %v", err)
+	}
+}
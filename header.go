@@ -0,0 +1,172 @@
+package persisted
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Log files begin with a header describing their contents:
+//
+//	+-------------+---------------+-------------------+-----------------+
+//	| magic (4 B) | version (1 B) | length (uint32)   | metadata (JSON) |
+//	+-------------+---------------+-------------------+-----------------+
+//
+// The metadata records the record format, the codec used for parameters, the
+// type of structure stored, when the file was created, its generation and the
+// schema version of its operations. Files written before the header was
+// introduced have no header at all and hold one JSON-encoded operation per
+// line, without framing. They are converted to the current format when opened
+// for writing.
+var fileMagic = [4]byte{0, 'P', 'S', 'T'}
+
+// The newest header version we know how to read, and the one we write.
+const fileHeaderVersion = 1
+
+const (
+	// Magic, version and metadata length.
+	fileHeaderPrefixSize = 9
+	maxMetadataSize      = 64 * 1024
+)
+
+type fileHeader struct {
+	// The header version, or 0 if the file has no header; see legacy.
+	version int
+	// The offset of the first record, just past the header.
+	size int64
+
+	Format  Format    `json:"format"`
+	Codec   string    `json:"codec,omitempty"`
+	Type    string    `json:"type,omitempty"`
+	Created time.Time `json:"created"`
+	// Orders the files making up a log stored as a snapshot plus a tail; see
+	// WithSnapshots. Always 0 otherwise.
+	Generation uint64 `json:"generation,omitempty"`
+	// The schema version of the operations in the file; see WithSchema.
+	Schema uint64 `json:"schema,omitempty"`
+}
+
+// WithType names the type of structure stored in the log, such as
+// "linkedlist". The name is recorded in the file header, and opening a file
+// recorded with a different name fails with ErrIncompatible. The structures in
+// this package set this themselves; it is intended for custom structures.
+func WithType(name string) Option {
+	return func(o *options) {
+		o.structureType = name
+	}
+}
+
+// Returns the header for a new file created with the given options.
+func newFileHeader(o *options, created time.Time) fileHeader {
+	return fileHeader{
+		version: fileHeaderVersion,
+		Format:  o.format,
+		Codec:   o.codec.Name(),
+		Type:    o.structureType,
+		Created: created.UTC(),
+		Schema:  o.schema,
+	}
+}
+
+// Writes the header and records its size.
+func (h *fileHeader) write(w io.Writer) error {
+	metadata, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 0, fileHeaderPrefixSize+len(metadata))
+	header = append(header, fileMagic[:]...)
+	header = append(header, fileHeaderVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(metadata)))
+	header = append(header, metadata...)
+	_, err = w.Write(header)
+	if err != nil {
+		return err
+	}
+	h.version = fileHeaderVersion
+	h.size = int64(len(header))
+	return nil
+}
+
+// Reads the header at the start of f.
+func readHeader(f *os.File) (h fileHeader, err error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return
+	}
+	var prefix [fileHeaderPrefixSize]byte
+	n, err := f.ReadAt(prefix[:], 0)
+	if err != nil && err != io.EOF {
+		return
+	}
+	err = nil
+	if n < len(fileMagic) || [4]byte(prefix[:4]) != fileMagic {
+		// No header, so this should be a file of JSON lines from before the header
+		// existed. Check that it at least starts like one so that we can fail
+		// early on a file which isn't a log at all.
+		h.Format = FormatJSON
+		if n > 0 && prefix[0] != '{' {
+			err = fmt.Errorf("%w: not a log file", ErrCorrupt)
+		}
+		return
+	}
+
+	h.version = int(prefix[4])
+	switch {
+	case h.version > fileHeaderVersion:
+		err = fmt.Errorf("%w: log file version %d is newer than the newest supported version, %d",
+			ErrIncompatible, h.version, fileHeaderVersion)
+	case h.version == fileHeaderVersion:
+		if n < fileHeaderPrefixSize {
+			err = fmt.Errorf("%w: truncated file header", ErrCorrupt)
+			return
+		}
+		length := binary.BigEndian.Uint32(prefix[5:9])
+		if length > maxMetadataSize || int64(length) > stat.Size()-fileHeaderPrefixSize {
+			err = fmt.Errorf("%w: file header claims %d bytes of metadata", ErrCorrupt, length)
+			return
+		}
+		metadata := make([]byte, length)
+		_, err = f.ReadAt(metadata, fileHeaderPrefixSize)
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(metadata, &h)
+		if err != nil {
+			err = fmt.Errorf("%w: undecodable file header: %v", ErrCorrupt, err)
+			return
+		}
+		h.size = fileHeaderPrefixSize + int64(length)
+	default:
+		err = fmt.Errorf("%w: invalid log file version %d", ErrCorrupt, h.version)
+	}
+	return
+}
+
+// Reports whether the file was written before the header was introduced, and
+// so holds one JSON-encoded operation per line rather than framed records.
+func (h fileHeader) legacy() bool {
+	return h.version == 0
+}
+
+// Returns an error wrapping ErrIncompatible if the file cannot be read with the
+// given options. Files without a header lack the fields, which are not
+// checked. A file with an older schema version can be read by migrating its
+// operations.
+func (h fileHeader) check(o *options) error {
+	if h.Type != "" && o.structureType != "" && h.Type != o.structureType {
+		return fmt.Errorf("%w: file holds a %s, not a %s", ErrIncompatible, h.Type, o.structureType)
+	}
+	if h.Codec != "" && h.Codec != o.codec.Name() {
+		return fmt.Errorf("%w: file was written with the %s codec, not %s",
+			ErrIncompatible, h.Codec, o.codec.Name())
+	}
+	if h.Schema > o.schema {
+		return fmt.Errorf("%w: file has schema version %d, newer than %d",
+			ErrIncompatible, h.Schema, o.schema)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package persisted
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// The header should record how the file was written, and compaction should
+// keep the creation time.
+func TestHeaderMetadata(t *testing.T) {
+	tf, err := ioutil.TempFile("", "temp-testing")
+	defer removeLogFiles(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Add(-time.Second)
+	l, err := NewLog(tf.Name(), func() []Operation { return nil },
+		WithCodec(Gob), WithFormat(FormatBinary), WithType("custom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	header, err := readHeader(l.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.version != fileHeaderVersion || header.Format != FormatBinary ||
+		header.Codec != "gob" || header.Type != "custom" {
+		t.Fatalf("Unexpected header %+v", header)
+	}
+	if header.Created.Before(before) || header.Created.After(time.Now()) {
+		t.Fatalf("Unexpected creation time %v", header.Created)
+	}
+
+	l.mu.Lock()
+	err = l.compact()
+	l.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compacted, err := readHeader(l.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compacted.Created.Equal(header.Created) {
+		t.Fatalf("Creation time changed from %v to %v on compaction", header.Created, compacted.Created)
+	}
+}
+
+func TestIncompatibleFiles(t *testing.T) {
+	t.Run("type", func(t *testing.T) {
+		m, err := NewMap[string, int](newLogFile(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		err = m.Set("a", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := m.log.file.Name()
+		err = m.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewLinkedList[int](path)
+		if !errors.Is(err, ErrIncompatible) {
+			t.Fatalf("Expected ErrIncompatible opening a map as a list; got %v", err)
+		}
+		_, err = NewLinkedList[int](path, WithReadOnly())
+		if !errors.Is(err, ErrIncompatible) {
+			t.Fatalf("Expected ErrIncompatible opening a map as a read-only list; got %v", err)
+		}
+	})
+
+	t.Run("codec", func(t *testing.T) {
+		tf, err := ioutil.TempFile("", "temp-testing")
+		defer removeLogFiles(tf.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := NewLog(tf.Name(), nil, WithCodec(Gob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewLog(tf.Name(), nil)
+		if !errors.Is(err, ErrIncompatible) {
+			t.Fatalf("Expected ErrIncompatible opening a gob log as JSON; got %v", err)
+		}
+	})
+
+	t.Run("version", func(t *testing.T) {
+		tf, err := ioutil.TempFile("", "temp-testing")
+		defer removeLogFiles(tf.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tf.Write(append(fileMagic[:], fileHeaderVersion+1, 0, 0, 0, 0))
+		tf.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewLog(tf.Name(), nil)
+		if !errors.Is(err, ErrIncompatible) {
+			t.Fatalf("Expected ErrIncompatible opening a newer file; got %v", err)
+		}
+	})
+}
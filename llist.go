@@ -1,138 +1,588 @@
 package persisted
 
 import (
-	"encoding/json"
 	"fmt"
+	"iter"
+	"sync"
 )
 
-// TODO: fix JSON encoding / decoding issues:
-// 		- ints come back as float64s
-//		- interfaces come back as maps
-
 // Operations we record in the log file.
 const (
-	_append = "__append__"
-	_push   = "__push__"
-	_pop    = "__pop__"
+	_append   = "__append__"
+	_push     = "__push__"
+	_pop      = "__pop__"
+	_shift    = "__shift__"
+	_insertAt = "__insert_at__"
+	_removeAt = "__remove_at__"
+	_setAt    = "__set_at__"
+	_clear    = "__clear__"
 )
 
-// TODO: either handle newlines / carriage returns or disallow them
-
-// LinkedList is a persisted, doubly-linked list of nodes. Each node can hold
-// data, so long as that data implements the Stringable interface. Initialize a
-// LinkedList by calling NewLinkedList.
-type LinkedList struct {
-	inner *inMemLinkedList
-	log   *log
+// LinkedList is a persisted, doubly-linked list of elements of type T. Elements
+// are recorded using the log's Codec and are decoded directly back into T on
+// replay, so an element read after a restart is identical to the one written.
+// Initialize a LinkedList by calling NewLinkedList.
+//
+// A LinkedList is safe for concurrent use. Reads may proceed in parallel, while
+// modifications are serialized.
+type LinkedList[T any] struct {
+	// Guards inner. Held for writing across both the in-memory change and the
+	// corresponding log append so that the two stay in step: a change which
+	// cannot be appended is undone. A list opened from a Store shares the
+	// Store's lock.
+	mu    *sync.RWMutex
+	inner *inMemLinkedList[T]
+	log   *Log
+	// The Store the list was opened from, if any, and the prefix of the keys of
+	// the operations it records in the Store's log.
+	store  *Store
+	prefix string
 }
 
 // NewLinkedList returns a new LinkedList anchored to the file specified by
 // the input filepath.
 //
 // If this file exists and is not empty, it is assumed that the file represents
-// a persisted LinkedList and the data structure will be re-constructed. If this
-// file does not exist or is empty, a new, empty LinkedList will be created. In
-// this case, a new file may be created by this constructor, but all parent
-// directories must already exist.
+// a persisted LinkedList of the same element type and the data structure will
+// be re-constructed. If this file does not exist or is empty, a new, empty
+// LinkedList will be created. In this case, a new file may be created by this
+// constructor, but all parent directories must already exist.
 //
-// The input DecodeFunction tells the LinkedList how to read the Stringable
-// types back from their marshalled form. It should be able to handle any
-// Stringables already encoded in the input file.
-func NewLinkedList(filepath string) (linkedList *LinkedList, err error) {
+// The options configure the underlying log.
+func NewLinkedList[T any](filepath string, opts ...Option) (linkedList *LinkedList[T], err error) {
 	// Initialize the log with the input file path.
-	linkedList = new(LinkedList)
-	linkedList.log, err = newLog(filepath, linkedList.getCallback(), json.Marshal, json.Unmarshal)
+	linkedList = newLinkedList[T](new(sync.RWMutex))
+	linkedList.log, err = NewLog(filepath, linkedList.getCallback(), append(opts, WithType("linkedlist"))...)
 	if err != nil {
 		return nil, err
 	}
-	// Initialize the inner linked list and populate it using the log.
-	linkedList.inner = new(inMemLinkedList)
-	err = linkedList.log.replay(linkedList.getOperationsMap())
+	// Populate the inner linked list using the log.
+	err = linkedList.log.Replay(linkedList.getOperationsMap())
 	if err != nil {
+		linkedList.log.Close()
 		return nil, err
 	}
 	return linkedList, nil
 }
 
+// Returns an empty list guarded by mu.
+func newLinkedList[T any](mu *sync.RWMutex) *LinkedList[T] {
+	return &LinkedList[T]{mu: mu, inner: new(inMemLinkedList[T])}
+}
+
 // Append adds the input element to the end of the list.
-func (ll *LinkedList) Append(newElement interface{}) error {
-	ll.inner.append(newElement)
-	return ll.log.add(newOperation(_append, newElement))
+func (ll *LinkedList[T]) Append(newElement T) error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.change(func(tx *ListTx[T]) error { return tx.Append(newElement) })
 }
 
 // Push adds the input element to the beginning of the list.
-func (ll *LinkedList) Push(newElement interface{}) error {
-	ll.inner.push(newElement)
-	return ll.log.add(newOperation(_push, newElement))
+func (ll *LinkedList[T]) Push(newElement T) error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.change(func(tx *ListTx[T]) error { return tx.Push(newElement) })
+}
+
+// Pop removes and returns the last element of the list. Returns ErrEmpty if the
+// list is empty.
+func (ll *LinkedList[T]) Pop() (popped T, err error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	err = ll.change(func(tx *ListTx[T]) (err error) {
+		popped, err = tx.Pop()
+		return
+	})
+	return
+}
+
+// Shift removes and returns the first element of the list. Returns ErrEmpty if
+// the list is empty.
+func (ll *LinkedList[T]) Shift() (shifted T, err error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	err = ll.change(func(tx *ListTx[T]) (err error) {
+		shifted, err = tx.Shift()
+		return
+	})
+	return
+}
+
+// InsertAt inserts the input element at the input position, moving the element
+// there and those after it back by one. The position may be the length of the
+// list, which appends the element. Returns an error wrapping ErrOutOfRange if
+// the position is outside the list.
+func (ll *LinkedList[T]) InsertAt(position int, newElement T) error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.change(func(tx *ListTx[T]) error { return tx.InsertAt(position, newElement) })
+}
+
+// RemoveAt removes and returns the element at the input position, moving those
+// after it forward by one. Returns an error wrapping ErrOutOfRange if there is
+// no element at the given position.
+func (ll *LinkedList[T]) RemoveAt(position int) (removed T, err error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	err = ll.change(func(tx *ListTx[T]) (err error) {
+		removed, err = tx.RemoveAt(position)
+		return
+	})
+	return
+}
+
+// Set replaces the element at the input position with the input element.
+// Returns an error wrapping ErrOutOfRange if there is no element at the given
+// position.
+func (ll *LinkedList[T]) Set(position int, newElement T) error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.change(func(tx *ListTx[T]) error { return tx.Set(position, newElement) })
 }
 
-// Pop removes and returns the last element of the list. Returns nil if the list
-// is empty.
-func (ll *LinkedList) Pop() (interface{}, error) {
-	popped := ll.inner.pop()
-	if popped == nil {
-		return nil, nil
+// Clear removes every element from the list, then compacts the list's log so
+// that the space taken up by the elements is reclaimed straight away.
+func (ll *LinkedList[T]) Clear() error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	err := ll.change(func(tx *ListTx[T]) error { return tx.Clear() })
+	if err != nil {
+		return err
 	}
-	return popped, ll.log.add(newOperation(_pop))
+	// Should compaction fail, the log still records that the list was cleared.
+	return ll.log.Compact()
 }
 
 // Get returns the element at the input position without removing it from the
-// list. Returns nil if there is no element at the given position.
-func (ll *LinkedList) Get(position int) interface{} {
+// list. The boolean is false if there is no element at the given position.
+func (ll *LinkedList[T]) Get(position int) (T, bool) {
+	ll.mu.RLock()
+	defer ll.mu.RUnlock()
 	return ll.inner.get(position)
 }
 
+// PeekFront returns the first element of the list without removing it. The
+// boolean is false if the list is empty.
+func (ll *LinkedList[T]) PeekFront() (T, bool) {
+	ll.mu.RLock()
+	defer ll.mu.RUnlock()
+	return ll.inner.get(0)
+}
+
+// PeekBack returns the last element of the list without removing it. The
+// boolean is false if the list is empty.
+func (ll *LinkedList[T]) PeekBack() (T, bool) {
+	ll.mu.RLock()
+	defer ll.mu.RUnlock()
+	return ll.inner.get(ll.inner.length - 1)
+}
+
+// Sync flushes every change made to the list so far to stable storage,
+// regardless of the SyncPolicy the list was created with.
+func (ll *LinkedList[T]) Sync() error {
+	return ll.log.Sync()
+}
+
+// Compact compacts the list's log now, whatever the CompactionPolicy it was
+// created with.
+func (ll *LinkedList[T]) Compact() error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.log.Compact()
+}
+
+// Close flushes the list to stable storage and releases its file. The list
+// can still be read after it is closed, but any attempt to modify it returns
+// ErrClosed. Closing a list opened from a Store closes the Store.
+func (ll *LinkedList[T]) Close() error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.log.Close()
+}
+
 // Length returns the number of elements in the list.
-func (ll *LinkedList) Length() int {
+func (ll *LinkedList[T]) Length() int {
+	ll.mu.RLock()
+	defer ll.mu.RUnlock()
 	return ll.inner.length
 }
 
 // Iterator returns a function which, when called, returns the next element in
-// the list. The iterator function begins at the first element and returns nil
-// when it has run out of elements. Uses the underlying structure, so behavior
-// is undefined if the list is modified between calls to the iterator function.
-func (ll *LinkedList) Iterator() func() interface{} {
-	return ll.inner.iterator()
+// the list. The iterator function begins at the first element and returns
+// false when it has run out of elements. The iterator works from a snapshot of
+// the list taken when Iterator is called, so it is unaffected by later
+// modifications.
+func (ll *LinkedList[T]) Iterator() func() (T, bool) {
+	ll.mu.RLock()
+	snapshot := ll.inner.slice()
+	ll.mu.RUnlock()
+
+	position := 0
+	return func() (T, bool) {
+		if position >= len(snapshot) {
+			var zero T
+			return zero, false
+		}
+		position++
+		return snapshot[position-1], true
+	}
+}
+
+// All returns an iterator over the positions and elements of the list, from
+// first to last. Unlike Iterator, it walks the list itself rather than a
+// snapshot, so it costs nothing up front and stopping early is free.
+//
+// The loop body may use the list, but if it or another goroutine modifies the
+// list before the last element is reached, the iteration ends rather than
+// carry on over nodes which may no longer be linked. Use Iterator to range over
+// a list which may change meanwhile.
+func (ll *LinkedList[T]) All() iter.Seq2[int, T] {
+	return ll.walk(false)
+}
+
+// Values returns an iterator over the elements of the list, from first to
+// last. It behaves like All.
+func (ll *LinkedList[T]) Values() iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for _, element := range ll.walk(false) {
+			if !yield(element) {
+				return
+			}
+		}
+	}
+}
+
+// Backward returns an iterator over the positions and elements of the list,
+// from last to first. It behaves like All.
+func (ll *LinkedList[T]) Backward() iter.Seq2[int, T] {
+	return ll.walk(true)
+}
+
+// Returns an iterator following the links between the nodes of the list in
+// one direction or the other. ll.mu is only held while reading a node, never
+// while yielding, so the loop body is free to use the list.
+func (ll *LinkedList[T]) walk(backward bool) iter.Seq2[int, T] {
+	return func(yield func(int, T) bool) {
+		ll.mu.RLock()
+		version := ll.inner.version
+		currNode, position, step := ll.inner.head, 0, 1
+		if backward {
+			currNode, position, step = ll.inner.tail, ll.inner.length-1, -1
+		}
+		for currNode != nil {
+			element, next := currNode.data, currNode.next
+			if backward {
+				next = currNode.previous
+			}
+			ll.mu.RUnlock()
+			if !yield(position, element) || next == nil {
+				return
+			}
+			currNode = next
+			position += step
+			ll.mu.RLock()
+			if ll.inner.version != version {
+				// next may have been unlinked meanwhile.
+				ll.mu.RUnlock()
+				return
+			}
+		}
+		ll.mu.RUnlock()
+	}
+}
+
+// Batch calls fn with a transaction through which it can modify the list as a
+// single unit. The changes fn makes take effect in memory as it makes them, and
+// are recorded in the log as a single record once it returns, so replay
+// applies either all of them or none. If fn returns an error or panics, or the
+// changes cannot be recorded, they are rolled back and the list is left as it
+// was.
+//
+// The list is locked while fn runs, so fn must only use the list through tx.
+// tx must not be used once fn has returned.
+func (ll *LinkedList[T]) Batch(fn func(tx *ListTx[T]) error) error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.change(fn)
+}
+
+// Calls fn with a new transaction and records the changes it makes in the log.
+// Every modifying method goes through here, so that a change which cannot be
+// recorded is undone rather than leaving the list ahead of its log. ll.mu must
+// be held.
+func (ll *LinkedList[T]) change(fn func(tx *ListTx[T]) error) error {
+	if err := ll.log.checkWritable(); err != nil {
+		return err
+	}
+	tx := ll.tx(new(transaction))
+	return tx.t.run(ll.log, func() error { return fn(tx) })
+}
+
+// In returns a view of the list, which must have been opened from the Store
+// running tx, through which the function passed to Store.Update can modify it.
+func (ll *LinkedList[T]) In(tx *StoreTx) *ListTx[T] {
+	tx.check(ll.store)
+	return ll.tx(tx.t)
+}
+
+func (ll *LinkedList[T]) tx(t *transaction) *ListTx[T] {
+	return &ListTx[T]{list: ll.inner, prefix: ll.prefix, t: t}
+}
+
+// ListTx is a transaction on a LinkedList, passed to the function given to
+// Batch, or a LinkedList's part in a Store transaction. Its methods behave like
+// those of the LinkedList, and see the changes made so far in the transaction.
+type ListTx[T any] struct {
+	list   *inMemLinkedList[T]
+	prefix string
+	t      *transaction
+}
+
+// Append adds the input element to the end of the list.
+func (tx *ListTx[T]) Append(newElement T) error {
+	if tx.t.done {
+		return ErrTxDone
+	}
+	tx.list.append(newElement)
+	tx.t.record(func() { tx.list.pop() }, tx.prefix+_append, newElement)
+	return nil
+}
+
+// Push adds the input element to the beginning of the list.
+func (tx *ListTx[T]) Push(newElement T) error {
+	if tx.t.done {
+		return ErrTxDone
+	}
+	tx.list.push(newElement)
+	tx.t.record(func() { tx.list.shift() }, tx.prefix+_push, newElement)
+	return nil
+}
+
+// Pop removes and returns the last element of the list. Returns ErrEmpty if the
+// list is empty.
+func (tx *ListTx[T]) Pop() (T, error) {
+	if tx.t.done {
+		var zero T
+		return zero, ErrTxDone
+	}
+	popped, ok := tx.list.pop()
+	if !ok {
+		return popped, ErrEmpty
+	}
+	tx.t.record(func() { tx.list.append(popped) }, tx.prefix+_pop)
+	return popped, nil
+}
+
+// Shift removes and returns the first element of the list. Returns ErrEmpty if
+// the list is empty.
+func (tx *ListTx[T]) Shift() (T, error) {
+	if tx.t.done {
+		var zero T
+		return zero, ErrTxDone
+	}
+	shifted, ok := tx.list.shift()
+	if !ok {
+		return shifted, ErrEmpty
+	}
+	tx.t.record(func() { tx.list.push(shifted) }, tx.prefix+_shift)
+	return shifted, nil
+}
+
+// InsertAt inserts the input element at the input position. Returns an error
+// wrapping ErrOutOfRange if the position is outside the list.
+func (tx *ListTx[T]) InsertAt(position int, newElement T) error {
+	if tx.t.done {
+		return ErrTxDone
+	}
+	if !tx.list.insertAt(position, newElement) {
+		return outOfRange(position, tx.list.length)
+	}
+	tx.t.record(func() { tx.list.removeAt(position) }, tx.prefix+_insertAt, position, newElement)
+	return nil
+}
+
+// RemoveAt removes and returns the element at the input position. Returns an
+// error wrapping ErrOutOfRange if there is no element at the given position.
+func (tx *ListTx[T]) RemoveAt(position int) (T, error) {
+	if tx.t.done {
+		var zero T
+		return zero, ErrTxDone
+	}
+	removed, ok := tx.list.removeAt(position)
+	if !ok {
+		return removed, outOfRange(position, tx.list.length)
+	}
+	tx.t.record(func() { tx.list.insertAt(position, removed) }, tx.prefix+_removeAt, position)
+	return removed, nil
+}
+
+// Set replaces the element at the input position with the input element.
+// Returns an error wrapping ErrOutOfRange if there is no element at the given
+// position.
+func (tx *ListTx[T]) Set(position int, newElement T) error {
+	if tx.t.done {
+		return ErrTxDone
+	}
+	replaced, ok := tx.list.set(position, newElement)
+	if !ok {
+		return outOfRange(position, tx.list.length)
+	}
+	tx.t.record(func() { tx.list.set(position, replaced) }, tx.prefix+_setAt, position, newElement)
+	return nil
+}
+
+// Clear removes every element from the list. Unlike LinkedList.Clear, this
+// does not compact the log.
+func (tx *ListTx[T]) Clear() error {
+	if tx.t.done {
+		return ErrTxDone
+	}
+	cleared := *tx.list
+	tx.list.clear()
+	tx.t.record(func() {
+		version := tx.list.version
+		*tx.list = cleared
+		tx.list.version = version + 1
+	}, tx.prefix+_clear)
+	return nil
+}
+
+// Get returns the element at the input position without removing it from the
+// list. The boolean is false if there is no element at the given position.
+func (tx *ListTx[T]) Get(position int) (T, bool) {
+	return tx.list.get(position)
+}
+
+// PeekFront returns the first element of the list without removing it. The
+// boolean is false if the list is empty.
+func (tx *ListTx[T]) PeekFront() (T, bool) {
+	return tx.list.get(0)
+}
+
+// PeekBack returns the last element of the list without removing it. The
+// boolean is false if the list is empty.
+func (tx *ListTx[T]) PeekBack() (T, bool) {
+	return tx.list.get(tx.list.length - 1)
+}
+
+// Length returns the number of elements in the list.
+func (tx *ListTx[T]) Length() int {
+	return tx.list.length
 }
 
 // Returns a callback function for the linked list which can be passed into the
-// newLog function.
-func (ll *LinkedList) getCallback() func() []operation {
-	return func() []operation {
-		ops := make([]operation, ll.Length())
-		iter := ll.Iterator()
-		for i := 0; i < ll.Length(); i++ {
-			// TODO: make sure there's a solid unit test for Iterator()
-			ops[i] = newOperation(_append, iter())
+// NewLog function. The log only calls this during Replay, before the list is
+// shared, or from within a modifying method which already holds ll.mu. The
+// callback must not lock.
+func (ll *LinkedList[T]) getCallback() SnapshotFunc {
+	return func() []Operation {
+		ops := make([]Operation, 0, ll.inner.length)
+		iter := ll.inner.iterator()
+		for element, ok := iter(); ok; element, ok = iter() {
+			ops = append(ops, NewOperation(_append, element))
 		}
 		return ops
 	}
 }
 
-func (ll *LinkedList) getOperationsMap() map[string]func(...interface{}) error {
-	opsMap := make(map[string]func(...interface{}) error)
-	opsMap[_append] = func(inputs ...interface{}) error {
-		if len(inputs) != 1 {
-			return fmt.Errorf("Expected 1 parameter. Received %d.", len(inputs))
+func (ll *LinkedList[T]) getOperationsMap() map[string]Handler {
+	opsMap := make(map[string]Handler)
+	opsMap[_append] = func(params Params) error {
+		element, err := decodeElement[T](params)
+		if err != nil {
+			return err
 		}
-		fmt.Println("appending during replay:")
-		fmt.Println(inputs[0])
-		ll.inner.append(inputs[0])
+		ll.inner.append(element)
 		return nil
 	}
-	opsMap[_pop] = func(inputs ...interface{}) error {
-		if len(inputs) != 0 {
-			return fmt.Errorf("Expected 0 parameter. Received %d.", len(inputs))
+	opsMap[_pop] = func(params Params) error {
+		if err := params.Expect(0); err != nil {
+			return err
 		}
 		ll.inner.pop()
 		return nil
 	}
-	opsMap[_push] = func(inputs ...interface{}) error {
-		if len(inputs) != 1 {
-			return fmt.Errorf("Expected 1 parameter. Received %d.", len(inputs))
+	opsMap[_push] = func(params Params) error {
+		element, err := decodeElement[T](params)
+		if err != nil {
+			return err
+		}
+		ll.inner.push(element)
+		return nil
+	}
+	opsMap[_shift] = func(params Params) error {
+		if err := params.Expect(0); err != nil {
+			return err
+		}
+		ll.inner.shift()
+		return nil
+	}
+	opsMap[_insertAt] = func(params Params) error {
+		position, element, err := decodePositionedElement[T](params)
+		if err != nil {
+			return err
+		}
+		if !ll.inner.insertAt(position, element) {
+			return fmt.Errorf("%w: insert at position %d is outside list of length %d",
+				ErrCorrupt, position, ll.inner.length)
+		}
+		return nil
+	}
+	opsMap[_removeAt] = func(params Params) error {
+		position, err := decodeElement[int](params)
+		if err != nil {
+			return err
+		}
+		if _, ok := ll.inner.removeAt(position); !ok {
+			return fmt.Errorf("%w: removal at position %d is outside list of length %d",
+				ErrCorrupt, position, ll.inner.length)
+		}
+		return nil
+	}
+	opsMap[_setAt] = func(params Params) error {
+		position, element, err := decodePositionedElement[T](params)
+		if err != nil {
+			return err
+		}
+		if _, ok := ll.inner.set(position, element); !ok {
+			return fmt.Errorf("%w: set at position %d is outside list of length %d",
+				ErrCorrupt, position, ll.inner.length)
+		}
+		return nil
+	}
+	opsMap[_clear] = func(params Params) error {
+		if err := params.Expect(0); err != nil {
+			return err
 		}
-		ll.inner.push(inputs[0])
+		ll.inner.clear()
 		return nil
 	}
 	return opsMap
 }
+
+// Returns an error wrapping ErrOutOfRange for the position in a list of the
+// given length.
+func outOfRange(position, length int) error {
+	return fmt.Errorf("%w: position %d in list of length %d", ErrOutOfRange, position, length)
+}
+
+// Decodes the single element parameter of an operation into a T.
+func decodeElement[T any](params Params) (element T, err error) {
+	if err = params.Expect(1); err != nil {
+		return
+	}
+	err = params.Decode(0, &element)
+	return
+}
+
+// Decodes the position and element parameters of an operation.
+func decodePositionedElement[T any](params Params) (position int, element T, err error) {
+	if err = params.Expect(2); err != nil {
+		return
+	}
+	if err = params.Decode(0, &position); err != nil {
+		return
+	}
+	err = params.Decode(1, &element)
+	return
+}
@@ -1,21 +1,25 @@
 package persisted
 
-type node struct {
-	previous *node
-	next     *node
-	data     *interface{}
+type node[T any] struct {
+	previous *node[T]
+	next     *node[T]
+	data     T
 }
 
 // The in-memory linked list which backs the persisted version.
-type inMemLinkedList struct {
-	head   *node
-	tail   *node
+type inMemLinkedList[T any] struct {
+	head   *node[T]
+	tail   *node[T]
 	length int
+	// Incremented by every change, so that iterators can tell when the list has
+	// changed under them.
+	version uint64
 }
 
-func (ll *inMemLinkedList) append(newElement interface{}) {
-	newNode := new(node)
-	newNode.data = &newElement
+func (ll *inMemLinkedList[T]) append(newElement T) {
+	ll.version++
+	newNode := new(node[T])
+	newNode.data = newElement
 	if ll.tail == nil {
 		// This is the first element.
 		ll.head = newNode
@@ -29,9 +33,10 @@ func (ll *inMemLinkedList) append(newElement interface{}) {
 	}
 }
 
-func (ll *inMemLinkedList) push(newElement interface{}) {
-	newNode := new(node)
-	newNode.data = &newElement
+func (ll *inMemLinkedList[T]) push(newElement T) {
+	ll.version++
+	newNode := new(node[T])
+	newNode.data = newElement
 	if ll.head == nil {
 		// This is the first element.
 		ll.head = newNode
@@ -45,42 +50,165 @@ func (ll *inMemLinkedList) push(newElement interface{}) {
 	}
 }
 
-func (ll *inMemLinkedList) pop() interface{} {
+// Removes and returns the last element. The boolean is false if the list was
+// empty.
+func (ll *inMemLinkedList[T]) pop() (T, bool) {
 	if ll.length == 0 {
-		return nil
+		var zero T
+		return zero, false
 	}
+	ll.version++
 
 	dataToReturn := ll.tail.data
 	ll.tail = ll.tail.previous
 	if ll.tail != nil {
 		ll.tail.next = nil
+	} else {
+		// The list is now empty.
+		ll.head = nil
 	}
 	ll.length--
 
-	return *dataToReturn
+	return dataToReturn, true
 }
 
-func (ll *inMemLinkedList) get(position int) interface{} {
+// Removes and returns the first element. The boolean is false if the list was
+// empty.
+func (ll *inMemLinkedList[T]) shift() (T, bool) {
+	if ll.length == 0 {
+		var zero T
+		return zero, false
+	}
+	ll.version++
+
+	dataToReturn := ll.head.data
+	ll.head = ll.head.next
+	if ll.head != nil {
+		ll.head.previous = nil
+	} else {
+		// The list is now empty.
+		ll.tail = nil
+	}
+	ll.length--
+
+	return dataToReturn, true
+}
+
+// Returns the element at the given position. The boolean is false if the
+// position is out of bounds.
+func (ll *inMemLinkedList[T]) get(position int) (T, bool) {
+	currNode := ll.nodeAt(position)
+	if currNode == nil {
+		var zero T
+		return zero, false
+	}
+	return currNode.data, true
+}
+
+// Returns the node at the given position, or nil if the position is out of
+// bounds. Walks from whichever end is nearer.
+func (ll *inMemLinkedList[T]) nodeAt(position int) *node[T] {
 	if position < 0 || ll.length-1 < position {
 		// Out of bounds.
 		return nil
 	}
-	currNode := ll.head
-	for currPosition := 0; currPosition < position; currPosition++ {
-		currNode = currNode.next
+	if position < ll.length/2 {
+		currNode := ll.head
+		for currPosition := 0; currPosition < position; currPosition++ {
+			currNode = currNode.next
+		}
+		return currNode
 	}
-	return *currNode.data
+	currNode := ll.tail
+	for currPosition := ll.length - 1; currPosition > position; currPosition-- {
+		currNode = currNode.previous
+	}
+	return currNode
+}
+
+// Inserts the element so that it ends up at the given position, which may be
+// the length of the list. Returns false if the position is out of bounds.
+func (ll *inMemLinkedList[T]) insertAt(position int, newElement T) bool {
+	switch {
+	case position < 0 || ll.length < position:
+		return false
+	case position == 0:
+		ll.push(newElement)
+		return true
+	case position == ll.length:
+		ll.append(newElement)
+		return true
+	}
+	ll.version++
+	after := ll.nodeAt(position)
+	newNode := &node[T]{previous: after.previous, next: after, data: newElement}
+	after.previous.next = newNode
+	after.previous = newNode
+	ll.length++
+	return true
+}
+
+// Removes and returns the element at the given position. The boolean is false
+// if the position is out of bounds.
+func (ll *inMemLinkedList[T]) removeAt(position int) (T, bool) {
+	currNode := ll.nodeAt(position)
+	switch {
+	case currNode == nil:
+		var zero T
+		return zero, false
+	case currNode == ll.head:
+		return ll.shift()
+	case currNode == ll.tail:
+		return ll.pop()
+	}
+	ll.version++
+	currNode.previous.next = currNode.next
+	currNode.next.previous = currNode.previous
+	ll.length--
+	return currNode.data, true
 }
 
-func (ll *inMemLinkedList) iterator() func() interface{} {
+// Replaces the element at the given position, returning the element it
+// replaced. The boolean is false if the position is out of bounds.
+func (ll *inMemLinkedList[T]) set(position int, newElement T) (T, bool) {
+	currNode := ll.nodeAt(position)
+	if currNode == nil {
+		var zero T
+		return zero, false
+	}
+	ll.version++
+	replaced := currNode.data
+	currNode.data = newElement
+	return replaced, true
+}
+
+// Removes every element.
+func (ll *inMemLinkedList[T]) clear() {
+	ll.version++
+	ll.head = nil
+	ll.tail = nil
+	ll.length = 0
+}
+
+func (ll *inMemLinkedList[T]) iterator() func() (T, bool) {
 	currNode := ll.head
 
-	return func() interface{} {
+	return func() (T, bool) {
 		if currNode == nil {
-			return nil
+			var zero T
+			return zero, false
 		}
 		dataToReturn := currNode.data
 		currNode = currNode.next
-		return *dataToReturn
+		return dataToReturn, true
+	}
+}
+
+// Returns the elements of the list, in order, as a new slice.
+func (ll *inMemLinkedList[T]) slice() []T {
+	elements := make([]T, 0, ll.length)
+	for currNode := ll.head; currNode != nil; currNode = currNode.next {
+		elements = append(elements, currNode.data)
 	}
+	return elements
 }
@@ -1,8 +1,9 @@
 package persisted
 
 import (
-	"fmt"
+	"errors"
 	"io/ioutil"
+	"math"
 	"os"
 	"testing"
 )
@@ -14,7 +15,7 @@ import (
 func TestPersistence(t *testing.T) {
 	t.Parallel()
 
-	ll, wipeTempFiles, err := createTemporaryLinkedList()
+	ll, wipeTempFiles, err := createTemporaryLinkedList[int]()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -22,7 +23,6 @@ func TestPersistence(t *testing.T) {
 
 	// Append 10 elements to the list. Their values reflect their position.
 	for i := 0; i < 10; i++ {
-		// err = ll.Append(integer{i})
 		err = ll.Append(i)
 		if err != nil {
 			t.Fatal(err)
@@ -31,12 +31,10 @@ func TestPersistence(t *testing.T) {
 	// We'll do a few pushes and pops as well.
 	for i := 10; i < 20; i += 2 {
 		// 2 pushes + 1 pop each loop.
-		// err = ll.Push(integer{i})
 		err = ll.Push(i)
 		if err != nil {
 			t.Fatal(err)
 		}
-		// err = ll.Push(integer{i + 1})
 		err = ll.Push(i + 1)
 		if err != nil {
 			t.Fatal(err)
@@ -48,7 +46,11 @@ func TestPersistence(t *testing.T) {
 	}
 
 	// Now create a new LinkedList from the existing one's file and compare.
-	llJr, err := NewLinkedList(ll.log.file.Name())
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	llJr, err := NewLinkedList[int](ll.log.file.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -65,7 +67,11 @@ func TestPersistence(t *testing.T) {
 
 	// Create another LinkedList off the new one and compare again to make sure
 	// there were no errors in re-writing the log.
-	llTheThird, err := NewLinkedList(llJr.log.file.Name())
+	err = llJr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	llTheThird, err := NewLinkedList[int](llJr.log.file.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,12 +86,326 @@ func TestPersistence(t *testing.T) {
 	}
 }
 
+// Changes made with the positional operations, and Shift and Clear, should all
+// be replayed.
+func TestPositionalPersistence(t *testing.T) {
+	t.Parallel()
+
+	ll, wipeTempFiles, err := createTemporaryLinkedList[int]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wipeTempFiles()
+	ll.log.compactionPolicy = CompactManually
+
+	for i := 0; i < 5; i++ {
+		err = ll.Append(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = ll.Shift()
+	if err == nil {
+		err = ll.InsertAt(2, 10)
+	}
+	if err == nil {
+		_, err = ll.RemoveAt(3)
+	}
+	if err == nil {
+		err = ll.Set(0, 20)
+	}
+	if err == nil {
+		err = ll.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{20, 2, 10, 4}
+	checkInts(t, ll, expected)
+	llJr, err := NewLinkedList[int](ll.log.file.Name(), WithCompactionPolicy(CompactManually))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInts(t, llJr, expected)
+
+	// Clear should leave nothing in the log but its header.
+	err = llJr.Clear()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size(llJr.log.file) != llJr.log.header.size {
+		t.Fatalf("Expected an empty log after Clear; file is %d bytes with a %d byte header",
+			size(llJr.log.file), llJr.log.header.size)
+	}
+	err = llJr.Append(30)
+	if err == nil {
+		err = llJr.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	llTheThird, err := NewLinkedList[int](ll.log.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llTheThird.Close()
+	checkInts(t, llTheThird, []int{30})
+}
+
+// A logged operation which cannot apply to the list as replayed so far means the
+// log is corrupt.
+func TestInconsistentLog(t *testing.T) {
+	t.Parallel()
+
+	path := newLogFile(t)
+	l, err := NewLog(path, nil, WithType("linkedlist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append(_append, 1)
+	if err == nil {
+		err = l.Append(_removeAt, 1)
+	}
+	if err == nil {
+		err = l.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewLinkedList[int](path)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected an error wrapping ErrCorrupt; got %v", err)
+	}
+}
+
+// A change which cannot be recorded in the log, here because JSON has no way to
+// represent NaN, should leave the structure as it was.
+func TestUnrecordableChange(t *testing.T) {
+	t.Parallel()
+
+	ll, err := NewLinkedList[float64](newLogFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ll.Append(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ll.Append(math.NaN()) == nil || ll.Set(0, math.NaN()) == nil {
+		t.Fatal("Expected an error recording NaN")
+	}
+	if ll.Length() != 1 {
+		t.Fatalf("Expected the list to be left with 1 element; it has %d", ll.Length())
+	}
+	if first, _ := ll.Get(0); first != 1 {
+		t.Fatalf("Expected the first element to be left as 1; it is %v", first)
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMap[string, float64](newLogFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Set("a", math.NaN()) == nil {
+		t.Fatal("Expected an error recording NaN")
+	}
+	if m.Len() != 0 {
+		t.Fatalf("Expected the map to be left empty; it has %d keys", m.Len())
+	}
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewQueue[float64](newLogFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Enqueue(math.NaN()) == nil {
+		t.Fatal("Expected an error recording NaN")
+	}
+	if q.Len() != 0 {
+		t.Fatalf("Expected the queue to be left empty; it has %d elements", q.Len())
+	}
+	err = q.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Elements should be decoded back into their original type when a LinkedList is
+// loaded from file, rather than into generic maps and float64s.
+func TestTypedPersistence(t *testing.T) {
+	t.Parallel()
+
+	ll, wipeTempFiles, err := createTemporaryLinkedList[integer]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wipeTempFiles()
+
+	for i := 0; i < 10; i++ {
+		err = ll.Append(integer{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	llJr, err := NewLinkedList[integer](ll.log.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if llJr.Length() != ll.Length() {
+		t.Fatal("LinkedList loaded from file does not have expected number of elements")
+	}
+	for i := 0; i < ll.Length(); i++ {
+		original, _ := ll.Get(i)
+		loaded, ok := llJr.Get(i)
+		if !ok || loaded != original {
+			t.Errorf("Element %d not equal. Original: %v Loaded: %v", i, original, loaded)
+		}
+	}
+}
+
+// Elements should round-trip through each of the built-in codecs.
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	for _, codec := range []Codec{JSON, Gob} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			tempFile, err := ioutil.TempFile("", "temp-testing")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer removeLogFiles(tempFile.Name())
+			tempFile.Close()
+
+			ll, err := NewLinkedList[integer](tempFile.Name(), WithCodec(codec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				err = ll.Append(integer{i})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = ll.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			llJr, err := NewLinkedList[integer](tempFile.Name(), WithCodec(codec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer llJr.Close()
+			if llJr.Length() != 10 {
+				t.Fatalf("Expected 10 elements; got %d", llJr.Length())
+			}
+			for i := 0; i < 10; i++ {
+				if got, _ := llJr.Get(i); got != (integer{i}) {
+					t.Errorf("Expected %v; got %v", integer{i}, got)
+				}
+			}
+		})
+	}
+}
+
+// A closed LinkedList can be read but not modified.
+func TestClosedLinkedList(t *testing.T) {
+	t.Parallel()
+
+	ll, wipeTempFiles, err := createTemporaryLinkedList[int]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wipeTempFiles()
+	for i := 0; i < 3; i++ {
+		err = ll.Append(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ll.Append(3); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Append; got %v", err)
+	}
+	if err = ll.Push(3); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Push; got %v", err)
+	}
+	if _, err = ll.Pop(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Pop; got %v", err)
+	}
+	if !slicesEqual(getIntegerSlice(ll), []int{0, 1, 2}) {
+		t.Errorf("Closed list should not have been modified: %v", getIntegerSlice(ll))
+	}
+
+	// The data should all be there when the list is loaded again.
+	llJr, err := NewLinkedList[int](ll.log.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llJr.Close()
+	if !slicesEqual(getIntegerSlice(llJr), []int{0, 1, 2}) {
+		t.Errorf("LinkedList loaded from file does not match expected structure: %v", getIntegerSlice(llJr))
+	}
+}
+
+// A LinkedList opened read-only alongside a writer sees the writer's data but
+// cannot be modified.
+func TestReadOnlyLinkedList(t *testing.T) {
+	t.Parallel()
+
+	ll, wipeTempFiles, err := createTemporaryLinkedList[int]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wipeTempFiles()
+	defer ll.Close()
+	for i := 0; i < 3; i++ {
+		err = ll.Append(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := NewLinkedList[int](ll.log.file.Name(), WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if !slicesEqual(getIntegerSlice(reader), []int{0, 1, 2}) {
+		t.Errorf("Read-only LinkedList does not match expected structure: %v", getIntegerSlice(reader))
+	}
+	if err = reader.Append(3); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Append; got %v", err)
+	}
+	if _, err = reader.Pop(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Pop; got %v", err)
+	}
+	if reader.Length() != 3 {
+		t.Error("Read-only list should not have been modified")
+	}
+}
+
 // Try constructing a LinkedList using a non-existing file in a non-existing
 // directory. This should fail.
 func TestNonCreatableFile(t *testing.T) {
 	t.Parallel()
 
-	_, err := NewLinkedList("non-existing-directory/temp")
+	_, err := NewLinkedList[int]("non-existing-directory/temp")
 	if err == nil {
 		t.Error("Constructor should have reported error for non-instantiable file")
 	}
@@ -101,7 +421,7 @@ func TestNonReadableFile(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer tempFile.Close()
-	defer os.Remove(tempFile.Name())
+	defer removeLogFiles(tempFile.Name())
 
 	// We need to write some data to the file so that the constructor tries to
 	// read it.
@@ -117,7 +437,7 @@ func TestNonReadableFile(t *testing.T) {
 	// Set no permissions whatsoever for this file.
 	os.Chmod(tempFile.Name(), 000)
 
-	_, err = NewLinkedList(tempFile.Name())
+	_, err = NewLinkedList[int](tempFile.Name())
 	if err == nil {
 		t.Error("Constructor should have reported error for non-readable file")
 	}
@@ -127,16 +447,20 @@ func TestNonWritableFile(t *testing.T) {
 	t.Parallel()
 
 	// Create a LinkedList with some data in it.
-	ll, wipeTempFiles, err := createTemporaryLinkedList()
+	ll, wipeTempFiles, err := createTemporaryLinkedList[integer]()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer wipeTempFiles()
 	ll.Append(integer{1})
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Now make the log file read-only and try to re-create a LinkedList from it.
 	os.Chmod(ll.log.file.Name(), 0444)
-	_, err = NewLinkedList(ll.log.file.Name())
+	_, err = NewLinkedList[integer](ll.log.file.Name())
 	if err == nil {
 		t.Error("Constructor should have reported error for non-writable file")
 	}
@@ -152,28 +476,23 @@ func TestBadInputFile(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer tempFile.Close()
-	defer os.Remove(tempFile.Name())
+	defer removeLogFiles(tempFile.Name())
 
 	_, err = tempFile.WriteString("\nbogus string")
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = NewLinkedList(tempFile.Name())
+	_, err = NewLinkedList[int](tempFile.Name())
 	if err == nil {
 		t.Error("Constructor should have reported error for badly-formatted file")
 	}
 }
 
-// Helper function. Assumes that all elements of llist are of type integer (see
-// llist_standard_test.go). Returns the integer form of all elements in-order as
-// a slice.
-func getIntegerSlice(llist *LinkedList) []int {
+// Helper function. Returns all elements of llist in-order as a slice.
+func getIntegerSlice(llist *LinkedList[int]) []int {
 	ints := make([]int, llist.Length())
 	for currentIndex := 0; currentIndex < llist.Length(); currentIndex++ {
-		// ints[currentIndex] = llist.Get(currentIndex).(integer).WrappedInt
-		fmt.Println("llist.Get:")
-		fmt.Println(llist.Get(currentIndex))
-		ints[currentIndex] = llist.Get(currentIndex).(int)
+		ints[currentIndex], _ = llist.Get(currentIndex)
 	}
 	return ints
 }
@@ -4,13 +4,17 @@ package persisted
 // a linked list.
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"strconv"
+	"sync"
 	"testing"
 )
 
-// This struct is just an integer which implements the Stringable interface.
+// This struct is just a wrapped integer, used to check that structs round-trip
+// through the log.
 type integer struct {
 	WrappedInt int
 }
@@ -18,7 +22,7 @@ type integer struct {
 func TestAppendAndGet(t *testing.T) {
 	t.Parallel()
 
-	ll, wipeTempFiles, err := createTemporaryLinkedList()
+	ll, wipeTempFiles, err := createTemporaryLinkedList[integer]()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -36,24 +40,28 @@ func TestAppendAndGet(t *testing.T) {
 		t.Error("Inserted 10 elements, length was not 10")
 	}
 	for i := 0; i < 10; i++ {
-		element := ll.Get(i).(integer)
-		if element.WrappedInt != i {
+		element, ok := ll.Get(i)
+		if !ok || element.WrappedInt != i {
 			t.Error("Expected: " + strconv.Itoa(i) + ", got: " + strconv.Itoa(element.WrappedInt))
 		}
 	}
 	if ll.Length() != 10 {
 		t.Error("Length should not have changed after Get calls")
 	}
-	// Confirm that calling Get on an invalid index returns nil.
-	if ll.Get(100) != nil || ll.Get(-1) != nil {
-		t.Error("Get should return nil for invalid index")
+	// Confirm that calling Get on an invalid index reports that there is no
+	// element.
+	if _, ok := ll.Get(100); ok {
+		t.Error("Get should return false for an index past the end")
+	}
+	if _, ok := ll.Get(-1); ok {
+		t.Error("Get should return false for a negative index")
 	}
 }
 
 func TestPushAndPop(t *testing.T) {
 	t.Parallel()
 
-	ll, wipeTempFiles, err := createTemporaryLinkedList()
+	ll, wipeTempFiles, err := createTemporaryLinkedList[integer]()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -71,36 +79,140 @@ func TestPushAndPop(t *testing.T) {
 		t.Error("Inserted 10 elements, length was not 10")
 	}
 
-	var element interface{}
+	var element integer
 	numberElements := ll.Length()
 	for i := 0; i < numberElements; i++ {
 		element, err = ll.Pop()
 		if err != nil {
 			t.Fatal(err)
 		}
-		elementAsInteger := element.(integer)
-		if elementAsInteger.WrappedInt != i {
+		if element.WrappedInt != i {
 			t.Error("Expected: " + strconv.Itoa(i) + ", got: " +
-				strconv.Itoa(elementAsInteger.WrappedInt))
+				strconv.Itoa(element.WrappedInt))
 		}
 	}
 	if ll.Length() != 0 {
 		t.Error("List should be empty after Pop calls")
 	}
-	// Confirm that calling Pop on an empty list returns nil.
+	// Confirm that calling Pop on an empty list returns ErrEmpty.
 	popped, err := ll.Pop()
+	if !errors.Is(err, ErrEmpty) {
+		t.Errorf("Expected ErrEmpty calling Pop on an empty list; got %v", err)
+	}
+	if popped != (integer{}) {
+		t.Error("Calling Pop on an empty list should return the zero value")
+	}
+}
+
+func TestShiftAndPeek(t *testing.T) {
+	t.Parallel()
+
+	ll, wipeTempFiles, err := createTemporaryLinkedList[int]()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if popped != nil {
-		t.Error("Calling Pop on an empty list should return nil")
+	defer wipeTempFiles()
+
+	if _, ok := ll.PeekFront(); ok {
+		t.Error("PeekFront should return false for an empty list")
+	}
+	if _, ok := ll.PeekBack(); ok {
+		t.Error("PeekBack should return false for an empty list")
+	}
+	for i := 0; i < 3; i++ {
+		err = ll.Append(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if front, ok := ll.PeekFront(); !ok || front != 0 {
+		t.Errorf("Expected 0 at the front; got %d", front)
+	}
+	if back, ok := ll.PeekBack(); !ok || back != 2 {
+		t.Errorf("Expected 2 at the back; got %d", back)
+	}
+	for i := 0; i < 3; i++ {
+		shifted, err := ll.Shift()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shifted != i {
+			t.Errorf("Expected to shift %d; got %d", i, shifted)
+		}
+	}
+	if ll.Length() != 0 {
+		t.Fatalf("Expected an empty list; length is %d", ll.Length())
+	}
+	shifted, err := ll.Shift()
+	if !errors.Is(err, ErrEmpty) {
+		t.Errorf("Expected ErrEmpty calling Shift on an empty list; got %v", err)
+	}
+	if shifted != 0 {
+		t.Error("Calling Shift on an empty list should return the zero value")
+	}
+}
+
+func TestPositionalOperations(t *testing.T) {
+	t.Parallel()
+
+	ll, wipeTempFiles, err := createTemporaryLinkedList[int]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wipeTempFiles()
+
+	// Build 0 to 5 out of order, inserting at the front, back and middle.
+	for _, insert := range []struct{ position, element int }{
+		{0, 1}, {1, 4}, {0, 0}, {2, 3}, {2, 2}, {5, 5},
+	} {
+		err = ll.InsertAt(insert.position, insert.element)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkInts(t, ll, []int{0, 1, 2, 3, 4, 5})
+	err = ll.Set(4, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInts(t, ll, []int{0, 1, 2, 3, 40, 5})
+	for _, remove := range []struct{ position, element int }{{5, 5}, {0, 0}, {1, 2}} {
+		removed, err := ll.RemoveAt(remove.position)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != remove.element {
+			t.Errorf("Expected to remove %d at position %d; got %d", remove.element, remove.position, removed)
+		}
+	}
+	checkInts(t, ll, []int{1, 3, 40})
+
+	if err = ll.InsertAt(4, 0); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("Expected ErrOutOfRange inserting past the end; got %v", err)
+	}
+	if err = ll.InsertAt(-1, 0); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("Expected ErrOutOfRange inserting at a negative position; got %v", err)
+	}
+	if _, err = ll.RemoveAt(3); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("Expected ErrOutOfRange removing past the end; got %v", err)
+	}
+	if err = ll.Set(3, 0); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("Expected ErrOutOfRange setting past the end; got %v", err)
+	}
+	checkInts(t, ll, []int{1, 3, 40})
+}
+
+func checkInts(t *testing.T, ll *LinkedList[int], expected []int) {
+	t.Helper()
+	if got := getIntegerSlice(ll); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v; got %v", expected, got)
 	}
 }
 
 func TestIterator(t *testing.T) {
 	t.Parallel()
 
-	ll, wipeTempFiles, err := createTemporaryLinkedList()
+	ll, wipeTempFiles, err := createTemporaryLinkedList[integer]()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -120,19 +232,22 @@ func TestIterator(t *testing.T) {
 	}
 	iter := ll.Iterator()
 	for i := 0; i < 10; i++ {
-		element := iter().(integer)
+		element, ok := iter()
+		if !ok {
+			t.Fatal("Iterator ran out of elements early")
+		}
 		if element.WrappedInt != i {
 			t.Error("Expected: " + strconv.Itoa(i) + ", got: " + strconv.Itoa(element.WrappedInt))
 		}
 	}
-	// Confirm that the iterator returns nil when it has exhausted the list.
-	if iter() != nil {
-		t.Error("Iterator should have returned nil after exhausting list")
+	// Confirm that the iterator returns false when it has exhausted the list.
+	if _, ok := iter(); ok {
+		t.Error("Iterator should have returned false after exhausting list")
 	}
 	// Confirm that the list is untouched.
 	for i := 0; i < 10; i++ {
-		element := ll.Get(i).(integer)
-		if element.WrappedInt != i {
+		element, ok := ll.Get(i)
+		if !ok || element.WrappedInt != i {
 			t.Error("Expected: " + strconv.Itoa(i) + ", got: " + strconv.Itoa(element.WrappedInt))
 		}
 	}
@@ -141,7 +256,174 @@ func TestIterator(t *testing.T) {
 	}
 }
 
-func createTemporaryLinkedList() (linkedList *LinkedList, wipeTempFiles func() error, err error) {
+// The iterator should see the list as it was when Iterator was called.
+func TestIteratorSnapshot(t *testing.T) {
+	t.Parallel()
+
+	ll, wipeTempFiles, err := createTemporaryLinkedList[integer]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wipeTempFiles()
+
+	for i := 0; i < 5; i++ {
+		err := ll.Append(integer{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	iter := ll.Iterator()
+	// Modify the list after creating the iterator.
+	_, err = ll.Pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ll.Push(integer{100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		element, ok := iter()
+		if !ok {
+			t.Fatal("Iterator ran out of elements early")
+		}
+		if element.WrappedInt != i {
+			t.Error("Expected: " + strconv.Itoa(i) + ", got: " + strconv.Itoa(element.WrappedInt))
+		}
+	}
+	if _, ok := iter(); ok {
+		t.Error("Iterator should have returned false after exhausting snapshot")
+	}
+}
+
+func TestRangeIterators(t *testing.T) {
+	t.Parallel()
+
+	ll, wipeTempFiles, err := createTemporaryLinkedList[*int]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wipeTempFiles()
+
+	// Nil elements should be iterated like any other.
+	one, three := 1, 3
+	for _, element := range []*int{nil, &one, nil, &three} {
+		err = ll.Append(element)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deref := func(p *int) int {
+		if p == nil {
+			return 0
+		}
+		return *p
+	}
+	var forward, backward, values []int
+	for i, element := range ll.All() {
+		if i != len(forward) {
+			t.Fatalf("Expected position %d from All; got %d", len(forward), i)
+		}
+		forward = append(forward, deref(element))
+	}
+	for i, element := range ll.Backward() {
+		if i != ll.Length()-1-len(backward) {
+			t.Fatalf("Expected position %d from Backward; got %d", ll.Length()-1-len(backward), i)
+		}
+		backward = append(backward, deref(element))
+	}
+	for element := range ll.Values() {
+		values = append(values, deref(element))
+	}
+	if !reflect.DeepEqual(forward, []int{0, 1, 0, 3}) || !reflect.DeepEqual(values, forward) {
+		t.Fatalf("Expected [0 1 0 3] from All and Values; got %v and %v", forward, values)
+	}
+	if !reflect.DeepEqual(backward, []int{3, 0, 1, 0}) {
+		t.Fatalf("Expected [3 0 1 0] from Backward; got %v", backward)
+	}
+
+	// Breaking out early is fine.
+	for i := range ll.All() {
+		if i == 1 {
+			break
+		}
+	}
+
+	// Modifying the list during the iteration ends it, except on the last
+	// element, where there is nothing left to walk.
+	values = nil
+	for element := range ll.Values() {
+		values = append(values, deref(element))
+		if err := ll.Push(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(values, forward[:1]) {
+		t.Fatalf("Expected the iteration to end after the list changed; got %v", values)
+	}
+	backward = nil
+	for _, element := range ll.Backward() {
+		backward = append(backward, deref(element))
+		if len(backward) == ll.Length() {
+			if err := ll.Append(nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(backward) != ll.Length()-1 {
+		t.Fatalf("Expected all %d elements from Backward; got %d", ll.Length()-1, len(backward))
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	t.Parallel()
+
+	ll, wipeTempFiles, err := createTemporaryLinkedList[integer]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wipeTempFiles()
+	// Make sure compaction happens while other goroutines are busy.
+	ll.log.compactionPolicy = CompactAtSize(1024)
+
+	const goroutines, appendsEach = 8, 100
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < appendsEach; i++ {
+				if err := ll.Append(integer{i}); err != nil {
+					t.Error(err)
+					return
+				}
+				// Read concurrently with the writes.
+				ll.Get(ll.Length() / 2)
+				iter := ll.Iterator()
+				for _, ok := iter(); ok; _, ok = iter() {
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ll.Length() != goroutines*appendsEach {
+		t.Fatalf("Expected %d elements; got %d", goroutines*appendsEach, ll.Length())
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	llJr, err := NewLinkedList[integer](ll.log.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if llJr.Length() != ll.Length() {
+		t.Fatalf("LinkedList loaded from file has %d elements; expected %d", llJr.Length(), ll.Length())
+	}
+}
+
+func createTemporaryLinkedList[T any]() (linkedList *LinkedList[T], wipeTempFiles func() error, err error) {
 	// Create a temporary file to anchor the LinkedList to.
 	tempFile, err := ioutil.TempFile("", "temp-testing")
 	if err != nil {
@@ -157,9 +439,11 @@ func createTemporaryLinkedList() (linkedList *LinkedList, wipeTempFiles func() e
 		if err != nil {
 			return err
 		}
+		// Not every test gets as far as creating the lock file.
+		os.Remove(tempFile.Name() + ".lock")
 		return nil
 	}
 
-	linkedList, err = NewLinkedList(tempFile.Name())
+	linkedList, err = NewLinkedList[T](tempFile.Name())
 	return
 }
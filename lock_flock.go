@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package persisted
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Takes an exclusive advisory lock on f without blocking. Returns ErrLocked if
+// another open file description, in this process or another, holds a lock.
+func lockExclusive(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
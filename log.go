@@ -1,222 +1,903 @@
 package persisted
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"sync"
+	"time"
 )
 
-// The log type defined in this file is used to actively record the state of
-// data structures in the persisted package. A data structure will initialize
-// the log at a given filepath, then record each operation which changes its
-// state.
+// Log is the persistence engine behind the data structures in this package,
+// and can be used to build custom persisted structures. A data structure
+// initializes the log at a given filepath, then records each operation which
+// changes its state by calling Append.
+//
 // When initializing an existing persisted data structure, the log can be
 // replayed to put the structure back in its prior state.
-// The log will be compacted upon replay as well as upon reaching certain
-// thresholds. This is to keep the log from becoming too long and making replay
-// a slow process.
-
-// Initialize the compaction threshold to 10 KB.
-const initialCompactionThreshold = 10 * 1024
-
-type log struct {
-	file                   *os.File
-	getCompactedOperations func() []operation
-	compactThreshold       int64
-	marshaler              marshalFunc
-	unmarshaler            unmarshalFunc
+//
+// The log is compacted when its CompactionPolicy says so, which it asks after
+// every append and once more at the end of replay, with the replayed
+// operations counted as appended. This is to keep the log from becoming too
+// long and making replay a slow process. Compaction replaces the contents of
+// the log with the operations returned by the log's SnapshotFunc.
+//
+// A Log is safe for concurrent use.
+type Log struct {
+	// Guards everything below.
+	mu               sync.Mutex
+	file             *os.File
+	lockFile         *os.File
+	snapshot         SnapshotFunc
+	logger           *slog.Logger
+	compactionPolicy CompactionPolicy
+	codec            Codec
+	// The options used for new files.
+	options *options
+	// The header of the current file, and the encoding of its records.
+	header   fileHeader
+	encoding recordEncoding
+	// The number of bytes discarded from a torn tail by the last replay, and the
+	// number of operations it had no Handler for, by key, along with those
+	// operations themselves, which compaction carries over.
+	discarded int64
+	skipped   map[string]int
+	unknown   []marshalledOperation
+	// Whether the last replay migrated any operations from an older schema, and
+	// how many operations it has replayed.
+	migrated   bool
+	replayed   int
+	syncPolicy SyncPolicy
+	// The number of appends since the file was last synced.
+	unsynced int
+	// The error from the last background sync, reported by Sync.
+	syncErr error
+	// Closed to stop background goroutines.
+	done           chan struct{}
+	closed         bool
+	compactOnClose bool
+	readOnly       bool
+	// Whether the log is stored as a snapshot plus a tail, and the snapshot
+	// being written in the background, if any.
+	snapshots bool
+	pending   *pendingSnapshot
+	// The compaction running in the background, if any.
+	compaction *backgroundCompaction
+	// For the CompactionPolicy: the size of the log after the last compaction,
+	// the number of appends and time since, and the number of compactions which
+	// have failed since.
+	liveSize           int64
+	opsSinceCompaction int
+	lastCompaction     time.Time
+	compactionFailures int
+	// For a segmented log: the maximum size of a segment, the directory holding
+	// the segments, the number of the segment being appended to and the total
+	// size of the segments before it.
+	segmentSize int64
+	dir         string
+	segment     uint64
+	sealedSize  int64
+	// If set, Replay passes operations with no Handler to route before applying
+	// the UnknownOperationPolicy. route reports whether it dealt with the
+	// operation.
+	route func(marshalledOperation) (bool, error)
 }
 
-// Represents some operation which changes the state of a persisted data
-// structure.
-type operation struct {
-	key        string
-	parameters []interface{}
+// Operation represents some operation which changes the state of a persisted
+// data structure. Key identifies the kind of operation and is used to look up
+// a Handler on replay.
+type Operation struct {
+	Key    string
+	Params []interface{}
 }
 
-// Used to marshal and unmarshal the parameters in an operation.
-type marshalFunc func(interface{}) ([]byte, error)
-type unmarshalFunc func([]byte, interface{}) error
+// SnapshotFunc returns the most compact series of operations which represent
+// the current state of a data structure. Replaying these operations into an
+// empty structure must rebuild the structure exactly.
+type SnapshotFunc func() []Operation
+
+// Handler applies a replayed operation to a data structure. Handlers are
+// typically closures over the structure being rebuilt.
+type Handler func(Params) error
+
+// Params holds the marshalled parameters of an operation read back from the
+// log. Handlers decode these into whatever types they expect, so values come
+// back exactly as they were recorded rather than as generic interface{} values.
+type Params struct {
+	marshalled [][]byte
+	codec      Codec
+}
 
-// Used for JSON encoding / decoding of operations.
+// An operation with its parameters marshalled by the log's Codec. Each
+// marshalled operation is encoded in the file's Format to form the payload of
+// one framed record in the log file. The parameters are opaque bytes to the
+// envelope, so the codec may produce any format.
 type marshalledOperation struct {
 	Key                  string
 	MarshalledParameters [][]byte
+	// The operations making up a batch, which are packed into the parameters
+	// when the batch is encoded. See AppendBatch.
+	batch []marshalledOperation
 }
 
-// Initializes a log backed by the file at the provided path. If this file
-// already exists, it will be interpreted as an existing log. If the file does
-// not exist it will be created, but all parent directories must exist.
+// NewLog initializes a log backed by the file at the provided path. If this
+// file already exists, it will be interpreted as an existing log and should be
+// replayed with Replay before any new operations are appended. If the file
+// does not exist it will be created, but all parent directories must exist.
+// With WithSegments, the path is that of a directory holding the log's
+// segments, which is created if need be.
 //
-// compactedOperationsCallback should return the most compact series of
-// operations which represent the data structure. This callback function may be
-// called multiple times. These calls are synchronous but no guarantees are made
-// as to which method calls will result in execution of the callback. The
-// returned slice must always represent the current state of the structure.
+// The snapshot function may be called multiple times. These calls are
+// synchronous but no guarantees are made as to which method calls will result
+// in execution of the callback. The returned slice must always represent the
+// current state of the structure. If snapshot is nil, the log is never
+// compacted.
 //
-// The marshal and unmarshal functions are used for parameters passed in to the
-// add method. These methods must produce valid JSON and a "round-tripped"
-// parameter (one which has been marshalled, then unmarshalled) must be
-// equivalent to its original self.
-func newLog(filepath string, compactedOperationsCallback func() []operation,
-	marshalFn marshalFunc, unmarshalFn unmarshalFunc) (*log, error) {
-	logFile, err := os.OpenFile(filepath, os.O_RDWR, os.ModePerm)
+// Operation parameters are marshalled using the Codec set by WithCodec, JSON by
+// default. Records are written in the Format set by WithFormat. The format,
+// codec and structure type are recorded in a header at the start of the file.
+// Opening an existing file checks the header, returning an error wrapping
+// ErrIncompatible if the file was written by a newer version of this package,
+// with a different codec, or for a different type of structure. The format is
+// always taken from the header.
+//
+// Only one Log at a time may have a file open for writing. This is enforced
+// with an advisory lock on a sidecar file, the log's path with ".lock"
+// appended. If another Log holds the lock, NewLog returns ErrLocked. Logs
+// opened using WithReadOnly do not take the lock.
+func NewLog(filepath string, snapshot SnapshotFunc, opts ...Option) (*Log, error) {
+	options := newOptions(opts)
+	if options.snapshots && options.segmentSize > 0 {
+		return nil, errors.New("WithSnapshots and WithSegments cannot be combined")
+	}
+	if options.readOnly {
+		logFile, header, segment, err := openLogFile(filepath, options)
+		if err != nil {
+			return nil, err
+		}
+		return &Log{
+			file:        logFile,
+			logger:      newLogger(options, filepath),
+			codec:       options.codec,
+			options:     options,
+			header:      header,
+			encoding:    newRecordEncoding(header.Format),
+			done:        make(chan struct{}),
+			readOnly:    true,
+			snapshots:   options.snapshots,
+			segmentSize: options.segmentSize,
+			dir:         filepath,
+			segment:     segment,
+		}, nil
+	}
+
+	logger := newLogger(options, filepath)
+	lockFile, err := os.OpenFile(filepath+".lock", os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
-	// TODO: check file
-	return &log{
-		logFile,
-		compactedOperationsCallback,
-		initialCompactionThreshold,
-		marshalFn,
-		unmarshalFn,
-	}, nil
+	err = lockExclusive(lockFile)
+	if err == nil {
+		// Now that we're the only writer, clean up after any compaction interrupted
+		// by a crash.
+		err = removeTempFiles(filepath)
+	}
+	if err == nil && options.snapshots {
+		err = recoverSnapshotFiles(filepath, logger)
+	}
+	var (
+		logFile *os.File
+		header  fileHeader
+		segment uint64
+	)
+	if err == nil {
+		logFile, header, segment, err = openLogFile(filepath, options)
+	}
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	l := &Log{
+		file:             logFile,
+		lockFile:         lockFile,
+		snapshot:         snapshot,
+		logger:           logger,
+		compactionPolicy: options.compaction,
+		lastCompaction:   time.Now(),
+		codec:            options.codec,
+		options:          options,
+		header:           header,
+		encoding:         newRecordEncoding(header.Format),
+		syncPolicy:       options.sync,
+		done:             make(chan struct{}),
+		compactOnClose:   options.compactOnClose,
+		snapshots:        options.snapshots,
+		segmentSize:      options.segmentSize,
+		dir:              filepath,
+		segment:          segment,
+	}
+	if l.syncPolicy.interval > 0 {
+		go l.syncPeriodically()
+	}
+	return l, nil
 }
 
-// Records the operation in the log.
-// TODO: change signature to add(key string, parameters ...interface{}) error
-func (l *log) add(op operation) error {
-	marshalledOp, err := op.marshal(l.marshaler)
+// Opens the file which is appended to, and checks its header. For a segmented
+// log this is the last segment, and its number is returned too.
+func openLogFile(path string, options *options) (*os.File, fileHeader, uint64, error) {
+	if options.segmentSize > 0 {
+		return openSegments(path, options)
+	}
+	if options.readOnly {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fileHeader{}, 0, err
+		}
+		header, err := readHeader(f)
+		if err == nil {
+			err = header.check(options)
+		}
+		if err != nil {
+			f.Close()
+			return nil, fileHeader{}, 0, err
+		}
+		return f, header, 0, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return nil, fileHeader{}, 0, err
+	}
+	header, err := prepareFile(f, options)
+	if err != nil {
+		f.Close()
+		return nil, fileHeader{}, 0, err
+	}
+	return f, header, 0, nil
+}
+
+// Writes a header to the log file if it is empty, otherwise reads the existing
+// header and checks that it is compatible with the options.
+func prepareFile(f *os.File, options *options) (fileHeader, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return fileHeader{}, err
+	}
+	if stat.Size() > 0 {
+		header, err := readHeader(f)
+		if err == nil {
+			err = header.check(options)
+		}
+		return header, err
+	}
+	header := newFileHeader(options, time.Now())
+	err = header.write(f)
+	return header, err
+}
+
+// Append records an operation with the given key and parameters in the log.
+// Whether the operation has reached stable storage when Append returns depends
+// on the log's SyncPolicy. Append only returns an error if the operation was
+// not recorded, in which case the log is left as it was.
+//
+// Once the CompactionPolicy calls for compaction, Append takes a snapshot and
+// compacts the log in the background. Appends carry on meanwhile
+// and are added to the compacted file before it replaces the log file. A
+// compaction which fails does not fail the Append which started or finished
+// it. The failure is logged and counted in CompactionStats.Failures, and the
+// CompactionPolicy is consulted again after the next append.
+func (l *Log) Append(key string, params ...interface{}) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkWritableLocked(); err != nil {
+		return err
+	}
+	op := NewOperation(key, params...)
+	marshalledOp, err := op.marshal(l.codec)
+	if err != nil {
+		return err
+	}
+	err = l.write(marshalledOp)
+	if err != nil {
+		return err
+	}
+	l.opsSinceCompaction++
+	l.appended()
+	return nil
+}
+
+// Writes the marshalled operation to the end of the log file as a single
+// record, syncing it if the SyncPolicy says so. If the record cannot be written
+// and synced it is cut off again, so that the caller may safely try again.
+// l.mu must be held.
+func (l *Log) write(marshalledOp marshalledOperation) error {
+	record, err := encodeRecord(l.encoding, marshalledOp)
 	if err != nil {
 		return err
 	}
-	_, err = l.file.Seek(0, 2)
+	offset, err := l.file.Seek(0, 2)
 	if err != nil {
 		return err
 	}
-	err = json.NewEncoder(l.file).Encode(marshalledOp)
+	_, err = l.file.Write(record)
+	if err == nil {
+		err = l.syncIfNecessary()
+	}
 	if err != nil {
+		if truncateErr := l.file.Truncate(offset); truncateErr != nil {
+			return fmt.Errorf("%w (and the record could not be removed: %v)", err, truncateErr)
+		}
 		return err
 	}
-	return l.compactIfNecessary()
+	l.encoding.commit(marshalledOp)
+	if l.compaction != nil {
+		l.compaction.buffered = append(l.compaction.buffered, marshalledOp)
+	}
+	return nil
+}
+
+// Rolls over to a new segment and compacts as necessary after a record has been
+// written. The record is in the log whatever happens here, so failures are
+// logged rather than returned, and are retried after a later append. l.mu must
+// be held.
+func (l *Log) appended() {
+	if l.segmentSize > 0 {
+		err := l.rollIfNecessary()
+		if err != nil {
+			l.logger.Error("segment rollover failed", "segment", l.segment, "error", err)
+		}
+	}
+	l.compactIfNecessary()
 }
 
-// Replays every operation in the log. The operation key is used to look up the
-// associated function in the input map. The function is then called with the
-// operation parameters.
-// The functions in the map should most likely be closures so that, when
+// Replay replays every operation in the log. The operation key is used to look
+// up the associated Handler in the input map. The Handler is then called with
+// the marshalled operation parameters, which it is responsible for decoding.
+// The Handlers in the map should most likely be closures so that, when
 // applied, they have the desired effect on the state of the data structure
 // backed by this log.
-func (l *log) replay(operationsMap map[string]func(...interface{}) error) error {
-	_, err := l.file.Seek(0, 0)
+//
+// If the process died while writing the final record, that record is
+// incomplete. It is truncated away and the number of bytes discarded is
+// reported by Discarded. Damage anywhere else in the file results in an error
+// wrapping ErrCorrupt. A read-only log skips an incomplete final record without
+// truncating it, since it may still be being written.
+//
+// Operations with no Handler are dealt with according to the log's
+// UnknownOperationPolicy, set by WithUnknownOperations.
+//
+// Once the log has been replayed it is compacted if the CompactionPolicy says
+// so, or if operations were migrated from an older schema. It is left as it is
+// under CompactManually.
+//
+// A log stored as a snapshot plus a tail, see WithSnapshots, replays the
+// snapshot followed by the tail, finishing any compaction interrupted by a
+// crash.
+func (l *Log) Replay(handlers map[string]Handler) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	l.discarded = 0
+	l.skipped = make(map[string]int)
+	l.unknown = nil
+	l.migrated = false
+	l.replayed = 0
+	// Replay rebuilds the structure, so a snapshot taken before now is no use.
+	l.abandonCompaction()
+	start := time.Now()
+	l.logger.Info("replay started")
+	err := l.replay(handlers)
 	if err != nil {
+		l.logger.Error("replay failed", "ops", l.replayed, "error", err)
 		return err
 	}
-	decoder := json.NewDecoder(l.file)
-	var marshalledOp marshalledOperation
+	for key, count := range l.skipped {
+		l.logger.Warn("replayed operations with no handler", "key", key, "count", count)
+	}
+	if l.migrated {
+		l.logger.Info("migrated operations", "schema", l.options.schema)
+	}
+	l.logger.Info("replay finished", "ops", l.replayed, "discarded", l.discarded, "duration", time.Since(start))
+	return nil
+}
+
+// Does the work of Replay. l.mu must be held.
+func (l *Log) replay(handlers map[string]Handler) error {
+	if l.snapshots {
+		return l.replaySnapshots(handlers)
+	}
+	if l.segmentSize > 0 {
+		return l.replaySegments(handlers)
+	}
+	encoding, torn, err := l.replayFile(l.file, l.header, handlers)
+	if err != nil {
+		return err
+	}
+	l.encoding = encoding
+	if l.readOnly {
+		return nil
+	}
+	if torn != nil {
+		err = l.truncate(l.file, torn.offset)
+		if err != nil {
+			return err
+		}
+	}
+	if l.header.legacy() {
+		err = l.convert()
+		if err != nil {
+			return err
+		}
+	}
+	if !l.migrated {
+		stats, err := l.compactionStats()
+		if err != nil {
+			return err
+		}
+		// The operations replayed are as good as appended since the last
+		// compaction, which we know nothing about.
+		stats.Ops = l.replayed
+		if !l.compactionPolicy.ShouldCompact(stats) {
+			return nil
+		}
+	}
+	// Compact now as we'd rather take a performance hit during initialization.
+	return l.compact()
+}
+
+// Applies every record in f, which has the given header, using the handlers.
+// Returns the state of the encoding after the last record, and the torn record
+// at the end of the file, if there is one. l.mu must be held.
+func (l *Log) replayFile(f *os.File, header fileHeader, handlers map[string]Handler) (recordEncoding, *tornRecordError, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = f.Seek(header.size, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.legacy() {
+		torn, err := l.replayLegacyFile(f, header, handlers)
+		return newRecordEncoding(header.Format), torn, err
+	}
+	// Start decoding afresh, as the encoding may carry state between records.
+	encoding := newRecordEncoding(header.Format)
+	reader := newRecordReader(f, header.size, stat.Size())
 	for {
-		err := decoder.Decode(&marshalledOp)
+		payload, err := reader.next()
 		if err == io.EOF {
-			break
+			return encoding, nil, nil
+		}
+		var torn *tornRecordError
+		if errors.As(err, &torn) {
+			return encoding, torn, nil
 		} else if err != nil {
-			return err
+			return nil, nil, err
+		}
+		marshalledOp, err := encoding.decode(payload)
+		ops := []marshalledOperation{marshalledOp}
+		if err == nil && marshalledOp.Key == batchKey {
+			ops, err = unpackBatch(header.Format, marshalledOp)
 		}
-		op, err := marshalledOp.unmarshal(l.unmarshaler)
 		if err != nil {
-			return errors.New("Error unmarshalling operation: " + err.Error())
+			return nil, nil, fmt.Errorf("%w: undecodable record at offset %d: %v",
+				ErrCorrupt, reader.offset-int64(len(payload))-recordHeaderSize, err)
+		}
+		for _, op := range ops {
+			err = l.apply(header, op, handlers)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// Applies every operation in f, a file written before records were framed,
+// using the handlers. Returns the incomplete line at the end of the file, if
+// there is one. l.mu must be held.
+func (l *Log) replayLegacyFile(f *os.File, header fileHeader, handlers map[string]Handler) (*tornRecordError, error) {
+	reader := newLegacyReader(f)
+	for {
+		marshalledOp, err := reader.next()
+		if err == io.EOF {
+			return nil, nil
 		}
-		opFunction, keyExists := operationsMap[op.key]
-		if !keyExists {
-			return errors.New("Key <" + op.key + "> found in log file but not operations map")
+		var torn *tornRecordError
+		if errors.As(err, &torn) {
+			return torn, nil
+		} else if err != nil {
+			return nil, err
 		}
-		fmt.Println("op:")
-		fmt.Println(op)
-		err = opFunction(op.parameters...)
+		err = l.apply(header, marshalledOp, handlers)
 		if err != nil {
-			return errors.New("Error applying operation: " + err.Error())
+			return nil, err
 		}
 	}
-	// Compact now as we'd rather take a performance hit during initialization.
-	return l.compact()
 }
 
-// Compact the log. This is equivalent to calling l.add, in order, for every
-// state change returned by l.getCompactedChanges().
-func (l *log) compact() error {
-	tempFile, err := ioutil.TempFile("", "TemporaryCompactionFile-"+filepath.Base(l.file.Name()))
+// Rewrites the log file, which was written before records were framed, in the
+// current format so that it can be appended to. Every operation in the file is
+// kept as it is, at its original schema version, so this needs no snapshot.
+// l.mu must be held.
+func (l *Log) convert() error {
+	_, err := l.file.Seek(0, 0)
 	if err != nil {
 		return err
 	}
-	ops := l.getCompactedOperations()
-	encoder := json.NewEncoder(tempFile)
-	for _, op := range ops {
-		marshalledOp, err := op.marshal(l.marshaler)
-		if err != nil {
-			return errors.New("Marshalling error during compaction: " + err.Error())
+	var ops []Operation
+	reader := newLegacyReader(l.file)
+	for {
+		marshalledOp, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
 		}
-		err = encoder.Encode(marshalledOp)
+		ops = append(ops, marshalledOp.raw())
+	}
+	header := l.newHeader(l.header.Generation)
+	header.Schema = l.header.Schema
+	var encoding recordEncoding
+	err = replaceFile(l.file.Name(), func(f *os.File) (err error) {
+		encoding, err = l.writeOperations(f, &header, ops)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	l.logger.Info("converted log file to the current format", "format", header.Format, "ops", len(ops))
+	return l.reopen(header, encoding)
+}
+
+// Applies a replayed operation from a file with the given header using the
+// handlers. l.mu must be held.
+func (l *Log) apply(header fileHeader, marshalledOp marshalledOperation, handlers map[string]Handler) error {
+	var err error
+	if header.Schema < l.options.schema {
+		marshalledOp, err = l.migrate(header.Schema, marshalledOp)
 		if err != nil {
-			return errors.New("Error during compaction: " + err.Error())
+			return err
 		}
+		l.migrated = true
+	}
+	l.replayed++
+	if l.replayed%replayProgressInterval == 0 {
+		l.logger.Info("replay progress", "ops", l.replayed)
+	}
+	handler, keyExists := handlers[marshalledOp.Key]
+	if !keyExists && l.route != nil {
+		keyExists, err = l.route(marshalledOp)
+		if keyExists || err != nil {
+			return err
+		}
+	}
+	if !keyExists {
+		return l.handleUnknown(marshalledOp)
+	}
+	err = handler(marshalledOp.params(l.codec))
+	if err != nil {
+		return fmt.Errorf("Error applying operation: %w", err)
+	}
+	return nil
+}
+
+// Close flushes the log to stable storage, compacting it first if the log was
+// configured to compact on close, and releases the log file. Like Sync, it
+// reports an error from a background sync which has not been reported yet.
+// Every method which modifies the log returns ErrClosed once it has been
+// closed, as does calling Close again.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	l.closed = true
+	close(l.done)
+	if l.readOnly {
+		return l.file.Close()
 	}
 
-	// If all went well, we can now over-write the existing log.
-	err = os.Rename(tempFile.Name(), l.file.Name())
+	// Let any snapshot being written in the background finish before releasing
+	// the lock.
+	err := l.waitForSnapshot()
+	if l.compactOnClose && l.snapshot != nil {
+		err = l.compact()
+	} else {
+		if compactErr := l.finishCompaction(true); err == nil {
+			err = compactErr
+		}
+		if syncErr := l.syncLocked(); err == nil {
+			err = syncErr
+		}
+	}
+	if err == nil {
+		err = l.syncErr
+	}
+	l.syncErr = nil
+	closeErr := l.file.Close()
+	// Closing the lock file releases the lock. The file itself is left in place;
+	// removing it would let another process lock a file which is about to
+	// disappear.
+	unlockErr := l.lockFile.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return unlockErr
+}
+
+// Returns ErrClosed or ErrReadOnly if the log cannot be modified.
+func (l *Log) checkWritable() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.checkWritableLocked()
+}
+
+// Like checkWritable, but l.mu must be held.
+func (l *Log) checkWritableLocked() error {
+	if l.closed {
+		return ErrClosed
+	}
+	if l.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Discarded returns the number of bytes discarded from the end of the log file
+// by the last call to Replay because they held an incompletely written record.
+func (l *Log) Discarded() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.discarded
+}
+
+// Truncates f to the given offset, discarding a torn tail. l.mu must be held.
+func (l *Log) truncate(f *os.File, offset int64) error {
+	stat, err := f.Stat()
 	if err != nil {
 		return err
 	}
-	l.file, err = os.OpenFile(l.file.Name(), os.O_RDWR, os.ModePerm)
+	err = f.Truncate(offset)
 	if err != nil {
 		return err
 	}
+	l.logger.Warn("discarded incompletely written record",
+		"file", f.Name(), "offset", offset, "bytes", stat.Size()-offset)
+	l.discarded += stat.Size() - offset
 	return nil
 }
 
-// Compact if size(log) > compaction threshold, otherwise no-op.
-func (l *log) compactIfNecessary() error {
+// Compact the log. l.mu must be held. This is equivalent to calling l.Append,
+// in order, for every operation returned by l.liveOperations(). The compacted
+// log is written to a new file which atomically replaces the old one, so a
+// crash part-way through leaves the old log intact. Unlike the compactions
+// started by Append, this runs to completion before returning, replacing any
+// running in the background.
+func (l *Log) compact() error {
+	if l.snapshot == nil {
+		return nil
+	}
+	if l.snapshots {
+		return l.checkpoint()
+	}
+	if l.segmentSize > 0 {
+		return l.compactSegments(true)
+	}
+	l.abandonCompaction()
+	start := l.compactionStarted(false)
+	err := l.compactFile()
+	l.compactionFinished(start, err)
+	return err
+}
+
+// Rewrites the log file in place of a single-file log. l.mu must be held.
+func (l *Log) compactFile() error {
+	ops := l.liveOperations()
+	header := l.newHeader(0)
+	var encoding recordEncoding
+	err := replaceFile(l.file.Name(), func(f *os.File) (err error) {
+		encoding, err = l.writeOperations(f, &header, ops)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = l.reopen(header, encoding)
+	if err != nil {
+		return err
+	}
 	stat, err := l.file.Stat()
 	if err != nil {
 		return err
 	}
-	if stat.Size() > l.compactThreshold {
-		err := l.compact()
+	l.compacted(stat.Size())
+	return nil
+}
+
+// Returns the header for a file replacing part or all of the log. The file is
+// in the current format, but it is still the same log, so it keeps its
+// creation time.
+func (l *Log) newHeader(generation uint64) fileHeader {
+	header := newFileHeader(l.options, l.header.Created)
+	if header.Created.IsZero() {
+		header.Created = time.Now().UTC()
+	}
+	header.Generation = generation
+	return header
+}
+
+// Writes the header followed by the operations to f. Returns the state of the
+// encoding after the last operation. This does not touch the log's state, so
+// l.mu need not be held.
+func (l *Log) writeOperations(f *os.File, header *fileHeader, ops []Operation) (recordEncoding, error) {
+	err := header.write(f)
+	if err != nil {
+		return nil, err
+	}
+	encoding := newRecordEncoding(header.Format)
+	for _, op := range ops {
+		marshalledOp, record, err := l.record(encoding, op)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("Marshalling error during compaction: %w", err)
 		}
-		stat, err = l.file.Stat()
+		_, err = f.Write(record)
 		if err != nil {
-			return err
-		}
-		// If, after compaction, the log is still over the threshold, then we need to
-		// increase the compaction threshold to avoid thrashing. We simply double the
-		// threshold each time this happens.
-		if stat.Size() > l.compactThreshold {
-			l.compactThreshold = l.compactThreshold * 2
+			return nil, fmt.Errorf("Error during compaction: %w", err)
 		}
+		encoding.commit(marshalledOp)
 	}
+	return encoding, nil
+}
+
+// Reopens the log file after it has been replaced by a file with the given
+// header, written using the given encoding. l.mu must be held.
+func (l *Log) reopen(header fileHeader, encoding recordEncoding) error {
+	newFile, err := os.OpenFile(l.file.Name(), os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// The old descriptor refers to the file we just replaced.
+	l.file.Close()
+	l.file = newFile
+	l.encoding = encoding
+	l.header = header
+	// Everything in the new file has been synced.
+	l.unsynced = 0
 	return nil
 }
 
-// Convenience function for creating operations.
-func newOperation(key string, parameters ...interface{}) operation {
-	return operation{key, parameters}
+// Compact in the background if the CompactionPolicy says so, otherwise no-op.
+// Also finishes a background compaction which has written its file. Failed
+// compactions are logged and counted by compactionFinished, so their errors
+// are not returned. l.mu must be held.
+func (l *Log) compactIfNecessary() {
+	if l.snapshot == nil {
+		return
+	}
+	if l.finishCompaction(false) != nil || l.compaction != nil {
+		return
+	}
+	stats, err := l.compactionStats()
+	if err != nil {
+		l.logger.Error("compaction policy check failed", "error", err)
+		return
+	}
+	if !l.compactionPolicy.ShouldCompact(stats) {
+		return
+	}
+	l.logger.Debug("compaction policy triggered", "size", stats.Size, "liveSize", stats.LiveSize,
+		"ops", stats.Ops, "elapsed", stats.Elapsed, "failures", stats.Failures)
+	if l.snapshots {
+		l.rotate()
+	} else if l.segmentSize > 0 {
+		l.compactSegments(false)
+	} else {
+		l.startCompaction()
+	}
+}
+
+// NewOperation is a convenience function for creating operations.
+func NewOperation(key string, params ...interface{}) Operation {
+	return Operation{key, params}
 }
 
-func (o *operation) marshal(marshal marshalFunc) (marshalledOp marshalledOperation, err error) {
-	marshalledParameters := make([][]byte, len(o.parameters))
-	for index, parameter := range o.parameters {
-		marshalledParameters[index], err = marshal(parameter)
+// A parameter which has already been marshalled by the log's Codec.
+type rawParam []byte
+
+func (o *Operation) marshal(codec Codec) (marshalledOp marshalledOperation, err error) {
+	marshalledParameters := make([][]byte, len(o.Params))
+	for index, parameter := range o.Params {
+		if raw, ok := parameter.(rawParam); ok {
+			marshalledParameters[index] = raw
+			continue
+		}
+		marshalledParameters[index], err = codec.Marshal(parameter)
 		if err != nil {
 			return
 		}
 	}
-	marshalledOp = marshalledOperation{o.key, marshalledParameters}
+	marshalledOp = marshalledOperation{Key: o.Key, MarshalledParameters: marshalledParameters}
 	return
 }
 
-func (m *marshalledOperation) unmarshal(unmarshal unmarshalFunc) (op operation, err error) {
-	parameters := make([]interface{}, len(m.MarshalledParameters))
-	for index, marshalledParameter := range m.MarshalledParameters {
-		err = unmarshal(marshalledParameter, &parameters[index])
+// Returns the operation marshalled and framed as a log record in the given
+// encoding. The marshalled operation must be committed to the encoding once the
+// record is written.
+func (l *Log) record(encoding recordEncoding, op Operation) (marshalledOperation, []byte, error) {
+	marshalledOp, err := op.marshal(l.codec)
+	if err != nil {
+		return marshalledOp, nil, err
+	}
+	record, err := encodeRecord(encoding, marshalledOp)
+	return marshalledOp, record, err
+}
+
+// Returns the marshalled operation framed as a log record in the given
+// encoding.
+func encodeRecord(encoding recordEncoding, marshalledOp marshalledOperation) ([]byte, error) {
+	if marshalledOp.batch != nil {
+		var err error
+		marshalledOp, err = packBatch(encoding.format(), marshalledOp.batch)
 		if err != nil {
-			return
+			return nil, err
 		}
 	}
-	op = operation{m.Key, parameters}
-	return
+	payload, err := encoding.encode(marshalledOp)
+	if err != nil {
+		return nil, err
+	}
+	return frameRecord(payload)
+}
+
+// Returns the operation with its parameters passed through as they are when it
+// is marshalled again.
+func (m *marshalledOperation) raw() Operation {
+	params := make([]interface{}, len(m.MarshalledParameters))
+	for i, param := range m.MarshalledParameters {
+		params[i] = rawParam(param)
+	}
+	return Operation{m.Key, params}
+}
+
+func (m *marshalledOperation) params(codec Codec) Params {
+	return Params{m.MarshalledParameters, codec}
+}
+
+// Raw returns the parameter at the given index as marshalled by the log's
+// Codec, or nil if there is no such parameter.
+func (p Params) Raw(index int) []byte {
+	if index < 0 || index >= len(p.marshalled) {
+		return nil
+	}
+	return p.marshalled[index]
+}
+
+// Len returns the number of parameters.
+func (p Params) Len() int {
+	return len(p.marshalled)
+}
+
+// Decode decodes the parameter at the given index into v, which should be a
+// pointer to a value of the type originally recorded.
+func (p Params) Decode(index int, v interface{}) error {
+	if index < 0 || index >= len(p.marshalled) {
+		return fmt.Errorf("No parameter at index %d; operation has %d", index, len(p.marshalled))
+	}
+	return p.codec.Unmarshal(p.marshalled[index], v)
+}
+
+// Expect returns an error unless there are exactly n parameters.
+func (p Params) Expect(n int) error {
+	if len(p.marshalled) != n {
+		return fmt.Errorf("Expected %d parameter(s). Received %d.", n, len(p.marshalled))
+	}
+	return nil
 }
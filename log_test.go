@@ -1,12 +1,13 @@
 package persisted
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 const (
@@ -17,21 +18,21 @@ const (
 
 func TestNewLogAndReplay(t *testing.T) {
 	tf, err := ioutil.TempFile("", "temp-testing")
-	defer os.Remove(tf.Name())
+	defer removeLogFiles(tf.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Try making a log for a slice of ints.
 	var s []int
-	callback := func() []operation {
-		ops := make([]operation, len(s))
+	callback := func() []Operation {
+		ops := make([]Operation, len(s))
 		for index, i := range s {
-			ops[index] = newOperation(appendKey, i)
+			ops[index] = NewOperation(appendKey, i)
 		}
 		return ops
 	}
-	l, err := newLog(tf.Name(), callback, json.Marshal, json.Unmarshal)
+	l, err := NewLog(tf.Name(), callback)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -39,7 +40,7 @@ func TestNewLogAndReplay(t *testing.T) {
 	// Perform some operations on the slice and record them in the log.
 	for i := 0; i < 10; i++ {
 		s = append(s, i)
-		err = l.add(newOperation(appendKey, i))
+		err = l.Append(appendKey, i)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -48,21 +49,25 @@ func TestNewLogAndReplay(t *testing.T) {
 	// Now try to create a new log off of the same file and replay it into a new
 	// slice. The result should be a copy of our original slice.
 	var newS []int
-	newCallback := func() []operation {
-		ops := make([]operation, len(newS))
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCallback := func() []Operation {
+		ops := make([]Operation, len(newS))
 		for index, i := range newS {
-			ops[index] = newOperation(appendKey, i)
+			ops[index] = NewOperation(appendKey, i)
 		}
 		return ops
 	}
-	newLog, err := newLog(tf.Name(), newCallback, json.Marshal, json.Unmarshal)
+	replayLog, err := NewLog(tf.Name(), newCallback)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	operationsMap := make(map[string]func(...interface{}) error)
-	operationsMap[appendKey] = bind(appendOperation, &newS)
-	err = newLog.replay(operationsMap)
+	operationsMap := make(map[string]Handler)
+	operationsMap[appendKey] = appendOperation(&newS)
+	err = replayLog.Replay(operationsMap)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -81,26 +86,26 @@ func TestNewLogAndReplay(t *testing.T) {
 
 func TestAdd(t *testing.T) {
 	var s []int
-	operationsMap := make(map[string]func(...interface{}) error)
-	operationsMap[appendKey] = bind(appendOperation, &s)
-	operationsMap[deleteKey] = bind(deleteOperation, &s)
-	operationsMap[replaceKey] = bind(replaceOperation, &s)
+	operationsMap := make(map[string]Handler)
+	operationsMap[appendKey] = appendOperation(&s)
+	operationsMap[deleteKey] = deleteOperation(&s)
+	operationsMap[replaceKey] = replaceOperation(&s)
 
 	tf, err := ioutil.TempFile("", "temp-testing")
-	defer os.Remove(tf.Name())
+	defer removeLogFiles(tf.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Make a log for s.
-	callback := func() []operation {
-		ops := make([]operation, len(s))
+	callback := func() []Operation {
+		ops := make([]Operation, len(s))
 		for index, i := range s {
-			ops[index] = newOperation(appendKey, i)
+			ops[index] = NewOperation(appendKey, i)
 		}
 		return ops
 	}
-	l, err := newLog(tf.Name(), callback, json.Marshal, json.Unmarshal)
+	l, err := NewLog(tf.Name(), callback)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -108,14 +113,14 @@ func TestAdd(t *testing.T) {
 	// Perform a series of operations and log each one.
 	for i := 0; i < 10; i++ {
 		s = append(s, i)
-		l.add(newOperation(appendKey, i))
+		l.Append(appendKey, i)
 	}
 	for i := 1; i < 10; i += 2 {
 		s[i] = 100
-		l.add(newOperation(replaceKey, i, 100))
+		l.Append(replaceKey, i, 100)
 	}
 	s = append(s[:5], s[6:]...)
-	l.add(newOperation(deleteKey, 5))
+	l.Append(deleteKey, 5)
 
 	// Now we test the accuracy of the log. We copy s over to sCopy and clear
 	// out s. Then we replay the log, which will rebuild s. Finally, we compare
@@ -130,7 +135,7 @@ func TestAdd(t *testing.T) {
 	if len(s) != 0 {
 		t.Fatal("Slice s should have been wiped out")
 	}
-	err = l.replay(operationsMap)
+	err = l.Replay(operationsMap)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -142,58 +147,62 @@ func TestAdd(t *testing.T) {
 func TestCompact(t *testing.T) {
 	var s []int
 	jennysNumber := 8675309
-	operationsMap := make(map[string]func(...interface{}) error)
-	operationsMap[appendKey] = bind(appendOperation, &s)
-	operationsMap[replaceKey] = bind(replaceOperation, &s)
+	operationsMap := make(map[string]Handler)
+	operationsMap[appendKey] = appendOperation(&s)
+	operationsMap[replaceKey] = replaceOperation(&s)
 
 	tf, err := ioutil.TempFile(".", "temp-testing")
-	defer os.Remove(tf.Name())
+	defer removeLogFiles(tf.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Make a log for s.
-	callback := func() []operation {
-		ops := make([]operation, len(s))
+	callback := func() []Operation {
+		ops := make([]Operation, len(s))
 		for index, i := range s {
-			ops[index] = newOperation(appendKey, i)
+			ops[index] = NewOperation(appendKey, i)
 		}
 		return ops
 	}
-	l, err := newLog(tf.Name(), callback, json.Marshal, json.Unmarshal)
+	l, err := NewLog(tf.Name(), callback)
 	if err != nil {
 		t.Fatal(err)
 	}
 	// Initially, the log has one entry.
 	s = append(s, jennysNumber)
-	l.add(newOperation(appendKey, jennysNumber))
+	l.Append(appendKey, jennysNumber)
 
 	// To test compaction we:
 	// 1. Record 1000 instances of a replace operation which does nothing.
-	//    Do this with a the max threshold so that no compaction occurs.
-	// 2. Lower the threshold and make sure that the file size decreases.
+	//    Do this with manual compaction so that no compaction occurs.
+	// 2. Set a size threshold and make sure that the file size decreases.
 	// 3. Continue to log the replace operations and make sure the file size
-	//    stays under the threshold. This verifies that compactIfNecessary is
-	//    running as designed.
+	//    stays under the threshold once each compaction finishes. This verifies
+	//    that compactIfNecessary is running as designed.
 
 	// Step 1.
-	l.compactThreshold = math.MaxInt64
+	l.compactionPolicy = CompactManually
 	for i := 0; i < 1000; i++ {
 		s[0] = jennysNumber
-		l.add(newOperation(replaceKey, 0, jennysNumber))
+		l.Append(replaceKey, 0, jennysNumber)
 	}
 
 	// Step 2.
 	// We add one more operation to trigger compaction.
 	newCompactThreshold := size(l.file) / 2
-	l.compactThreshold = newCompactThreshold
-	l.add(newOperation(replaceKey, 0, jennysNumber))
+	l.compactionPolicy = CompactAtSize(newCompactThreshold)
+	l.Append(replaceKey, 0, jennysNumber)
+	err = waitForCompaction(l)
+	if err != nil {
+		t.Fatal(err)
+	}
 	// Make sure the new log size is correct and that the log is still accurate.
 	if size(l.file) > newCompactThreshold {
 		t.Fatal("Compaction did not decrease file size as expected")
 	}
 	s = make([]int, 0)
-	err = l.replay(operationsMap)
+	err = l.Replay(operationsMap)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -204,112 +213,603 @@ func TestCompact(t *testing.T) {
 	// Step 3.
 	for i := 0; i < 5000; i++ {
 		s[0] = jennysNumber
-		l.add(newOperation(replaceKey, 0, jennysNumber))
+		l.Append(replaceKey, 0, jennysNumber)
+		err = waitForCompaction(l)
+		if err != nil {
+			t.Fatal(err)
+		}
 		if size(l.file) > newCompactThreshold {
 			t.Fatal("Log file over compaction threshold")
 		}
 	}
 }
 
-func TestOperationRoundtrip(t *testing.T) {
-	params := []interface{}{1, 2.3, "string param"}
-	op := operation{"dummy string", params}
-	marshalledOp, err := op.marshal(json.Marshal)
+// A log without a snapshot function should never be compacted.
+func TestNilSnapshot(t *testing.T) {
+	tf, err := ioutil.TempFile("", "temp-testing")
+	defer removeLogFiles(tf.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
-	roundtrippedOp, err := marshalledOp.unmarshal(json.Unmarshal)
+
+	var s []int
+	operationsMap := map[string]Handler{appendKey: appendOperation(&s)}
+	l, err := NewLog(tf.Name(), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Check equality.
-	if op.key != roundtrippedOp.key {
-		t.Fatalf("Keys not equal. Original: %s Roundtripped: %s", op.key, roundtrippedOp.key)
+	l.compactionPolicy = CompactAtSize(0)
+	for i := 0; i < 10; i++ {
+		err = l.Append(appendKey, i)
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
-	if len(op.parameters) != len(roundtrippedOp.parameters) {
-		t.Fatalf("Operations do not contain equal numbers of parameters. Original: %d Roundtripped: %d",
-			len(op.parameters), len(roundtrippedOp.parameters))
+	sizeBeforeReplay := size(l.file)
+	err = l.Replay(operationsMap)
+	if err != nil {
+		t.Fatal(err)
 	}
-	roundtrippedInt, ok := roundtrippedOp.parameters[0].(float64)
-	if !ok {
-		t.Fatalf("Roundtripped parameter was not of expected type (int). Instead was %T",
-			roundtrippedOp.parameters[0])
+	if len(s) != 10 {
+		t.Fatalf("Expected 10 elements after replay; got %d", len(s))
 	}
-	if int(roundtrippedInt) != op.parameters[0] {
-		t.Fatalf("Parameter 0 not equal. Original: %d Roundtripped: %d",
-			op.parameters[0], roundtrippedInt)
+	if size(l.file) != sizeBeforeReplay {
+		t.Fatal("Log without a snapshot function should not have been compacted")
 	}
-	roundtrippedFloat, ok := roundtrippedOp.parameters[1].(float64)
-	if !ok {
-		t.Fatalf("Roundtripped parameter was not of expected type (int). Instead was %T",
-			roundtrippedOp.parameters[0])
+}
+
+// Simulate a crash part-way through writing the final record. Replay should
+// recover every complete record and truncate away the partial one.
+func TestTornWrite(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		damage func(record []byte) []byte
+	}{
+		{"partial header", func(r []byte) []byte { return r[:recordHeaderSize/2] }},
+		{"partial payload", func(r []byte) []byte { return r[:len(r)-3] }},
+		{"bad checksum", func(r []byte) []byte { r[len(r)-1]++; return r }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tf, err := ioutil.TempFile("", "temp-testing")
+			defer removeLogFiles(tf.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := NewLog(tf.Name(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				err = l.Append(appendKey, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			completeSize := size(l.file)
+
+			// Write a damaged version of an eleventh record.
+			op := NewOperation(appendKey, 10)
+			_, record, err := l.record(l.encoding, op)
+			if err != nil {
+				t.Fatal(err)
+			}
+			damaged := tc.damage(record)
+			_, err = l.file.Write(damaged)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var s []int
+			err = l.Replay(map[string]Handler{appendKey: appendOperation(&s)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slicesEqual(s, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+				t.Fatalf("Complete records were not replayed correctly: %v", s)
+			}
+			if l.Discarded() != int64(len(damaged)) {
+				t.Fatalf("Expected %d bytes discarded; got %d", len(damaged), l.Discarded())
+			}
+			if size(l.file) != completeSize {
+				t.Fatalf("Expected log to be truncated to %d bytes; was %d", completeSize, size(l.file))
+			}
+		})
 	}
-	if roundtrippedFloat != op.parameters[1] {
-		t.Fatalf("Parameter 0 not equal. Original: %f Roundtripped: %f",
-			op.parameters[1], roundtrippedFloat)
+}
+
+// Damage to a record other than the last should be reported as corruption
+// rather than silently discarding everything after it.
+func TestCorruptRecord(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// The offset of the byte to overwrite, given the offset of the second
+		// record.
+		offset func(second int64) int64
+	}{
+		{"payload", func(second int64) int64 { return second + recordHeaderSize + 1 }},
+		// A length pointing past the end of the file must not pass for a torn
+		// record.
+		{"length", func(second int64) int64 { return second }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := NewLog(newLogFile(t), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			var second int64
+			for i := 0; i < 10; i++ {
+				err = l.Append(appendKey, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i == 0 {
+					second = size(l.file)
+				}
+			}
+			_, err = l.file.WriteAt([]byte{1}, tc.offset(second))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var s []int
+			err = l.Replay(map[string]Handler{appendKey: appendOperation(&s)})
+			if !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("Expected ErrCorrupt; got %v", err)
+			}
+			if l.Discarded() != 0 {
+				t.Fatalf("Expected nothing discarded; %d bytes were", l.Discarded())
+			}
+		})
 	}
-	if roundtrippedOp.parameters[2] != op.parameters[2] {
-		t.Fatalf("Parameter 2 not equal. Original: %s Roundtripped: %s",
-			op.parameters[2], roundtrippedOp.parameters[2])
+}
+
+func TestSyncPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   SyncPolicy
+		unsynced []int
+	}{
+		// The number of unsynced appends expected after each of four appends.
+		{"always", SyncAlways, []int{0, 0, 0, 0}},
+		{"never", SyncNever, []int{1, 2, 3, 4}},
+		{"every 2", SyncEvery(2), []int{1, 0, 1, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tf, err := ioutil.TempFile("", "temp-testing")
+			defer removeLogFiles(tf.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := NewLog(tf.Name(), nil, WithSync(tc.policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, expected := range tc.unsynced {
+				err = l.Append(appendKey, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if l.unsynced != expected {
+					t.Fatalf("After append %d expected %d unsynced appends; got %d", i, expected, l.unsynced)
+				}
+			}
+			// An explicit sync should always flush.
+			err = l.Sync()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.unsynced != 0 {
+				t.Fatal("Sync did not flush the log")
+			}
+		})
 	}
 }
 
-// -- Helper functions --
+func TestSyncInterval(t *testing.T) {
+	tf, err := ioutil.TempFile("", "temp-testing")
+	defer removeLogFiles(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLog(tf.Name(), nil, WithSync(SyncInterval(time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append(appendKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		unsynced := l.unsynced
+		l.mu.Unlock()
+		if unsynced == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Background sync never ran")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A failed background sync should be reported by the next Sync or Close, even
+// if a later background sync succeeds.
+func TestFailedBackgroundSync(t *testing.T) {
+	path := newLogFile(t)
+	l, err := NewLog(path, nil, WithSync(SyncInterval(time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A closed file stands in for one whose sync fails.
+	broken, err := os.Open(path)
+	if err == nil {
+		err = broken.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor := func(what string, done func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			l.mu.Lock()
+			ok := done()
+			l.mu.Unlock()
+			if ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Background sync never %s", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	failThenSucceed := func() {
+		err := l.Append(appendKey, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.mu.Lock()
+		file := l.file
+		l.file = broken
+		l.unsynced = 1
+		l.mu.Unlock()
+		waitFor("failed", func() bool { return l.syncErr != nil })
+		l.mu.Lock()
+		l.file = file
+		l.mu.Unlock()
+		waitFor("succeeded", func() bool { return l.unsynced == 0 })
+	}
+
+	failThenSucceed()
+	if err = l.Sync(); err == nil {
+		t.Fatal("Expected Sync to report the failed background sync")
+	}
+	if err = l.Sync(); err != nil {
+		t.Fatalf("Expected the failure to be reported once; got %v", err)
+	}
+	failThenSucceed()
+	if err = l.Close(); err == nil || err == ErrClosed {
+		t.Fatalf("Expected Close to report the failed background sync; got %v", err)
+	}
+}
+
+// Compaction should happen alongside the log file, leave no temporary files
+// behind, and clean up any left behind by a crash.
+func TestCompactionFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "log")
+	err := ioutil.WriteFile(path, nil, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a compaction interrupted by a crash.
+	orphan := filepath.Join(dir, tempFilePrefix(path)+"12345")
+	err = ioutil.WriteFile(orphan, []byte("partial"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s []int
+	callback := func() []Operation {
+		ops := make([]Operation, len(s))
+		for index, i := range s {
+			ops[index] = NewOperation(appendKey, i)
+		}
+		return ops
+	}
+	l, err := NewLog(path, callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatal("Orphaned temporary file was not removed")
+	}
+	l.compactionPolicy = CompactAtSize(0)
+	for i := 0; i < 10; i++ {
+		s = append(s, i)
+		err = l.Append(appendKey, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = waitForCompaction(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "log" || entries[1].Name() != "log.lock" {
+		t.Fatalf("Expected only the log and lock files in %s; found %v", dir, entries)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Fatalf("Compaction changed file permissions from %v to %v", os.FileMode(0640), info.Mode().Perm())
+	}
+}
+
+func TestClose(t *testing.T) {
+	for _, compactOnClose := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compactOnClose=%t", compactOnClose), func(t *testing.T) {
+			tf, err := ioutil.TempFile("", "temp-testing")
+			defer removeLogFiles(tf.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := []int{0}
+			callback := func() []Operation {
+				ops := make([]Operation, len(s))
+				for index, i := range s {
+					ops[index] = NewOperation(appendKey, i)
+				}
+				return ops
+			}
+			l, err := NewLog(tf.Name(), callback, WithCompactOnClose(compactOnClose))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = l.Append(appendKey, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				err = l.Append(replaceKey, 0, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			sizeBeforeClose := size(l.file)
+			file := l.file
+
+			err = l.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = file.Stat(); !errors.Is(err, os.ErrClosed) {
+				t.Fatal("Close did not release the log file")
+			}
+			if err = l.Append(appendKey, 1); !errors.Is(err, ErrClosed) {
+				t.Fatalf("Expected ErrClosed from Append; got %v", err)
+			}
+			if err = l.Sync(); !errors.Is(err, ErrClosed) {
+				t.Fatalf("Expected ErrClosed from Sync; got %v", err)
+			}
+			if err = l.Close(); !errors.Is(err, ErrClosed) {
+				t.Fatalf("Expected ErrClosed from second Close; got %v", err)
+			}
+
+			info, err := os.Stat(tf.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compacted := info.Size() < sizeBeforeClose; compacted != compactOnClose {
+				t.Fatalf("Expected compaction on close: %t; size went from %d to %d",
+					compactOnClose, sizeBeforeClose, info.Size())
+			}
+		})
+	}
+}
 
-func appendOperation(params ...interface{}) error {
-	slicePtr, ints, err := doTypeAssertions(2, params)
+// Compaction replaces the log file, so the descriptor for the old one should be
+// released.
+func TestCompactionClosesOldFile(t *testing.T) {
+	tf, err := ioutil.TempFile("", "temp-testing")
+	defer removeLogFiles(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLog(tf.Name(), func() []Operation { return nil })
 	if err != nil {
-		return err
+		t.Fatal(err)
+	}
+	oldFile := l.file
+	err = l.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = oldFile.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatal("Compaction did not close the old log file")
 	}
-	*slicePtr = append(*slicePtr, ints[0])
-	return nil
 }
 
-func deleteOperation(params ...interface{}) error {
-	slicePtr, ints, err := doTypeAssertions(2, params)
+// Only one writer may have a log open at a time, but read-only logs don't need
+// the lock.
+func TestLocking(t *testing.T) {
+	tf, err := ioutil.TempFile("", "temp-testing")
+	defer removeLogFiles(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLog(tf.Name(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = l.Append(appendKey, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Leave a partially written record at the end, as if mid-write.
+	_, err = l.file.Write([]byte{0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizeWithPartialRecord := size(l.file)
+
+	if _, err = NewLog(tf.Name(), nil); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked opening a second writer; got %v", err)
+	}
+
+	reader, err := NewLog(tf.Name(), nil, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s []int
+	err = reader.Replay(map[string]Handler{appendKey: appendOperation(&s)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 10 {
+		t.Fatalf("Expected 10 elements from read-only replay; got %d", len(s))
+	}
+	if size(l.file) != sizeWithPartialRecord {
+		t.Fatal("Read-only replay should not truncate the log")
+	}
+	if err = reader.Append(appendKey, 10); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly from Append; got %v", err)
+	}
+	err = reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the writer is closed, another can open the log.
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = NewLog(tf.Name(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Close()
 	if err != nil {
-		return err
+		t.Fatal(err)
 	}
-	indexToDelete := ints[0]
-	*slicePtr = append((*slicePtr)[:indexToDelete], (*slicePtr)[indexToDelete+1:]...)
-	return nil
 }
 
-func replaceOperation(params ...interface{}) error {
-	slicePtr, ints, err := doTypeAssertions(3, params)
+func TestOperationRoundtrip(t *testing.T) {
+	params := []interface{}{1, 2.3, "string param", integer{4}}
+	op := NewOperation("dummy string", params...)
+	marshalledOp, err := op.marshal(JSON)
 	if err != nil {
-		return err
+		t.Fatal(err)
+	}
+	roundtripped := marshalledOp.params(JSON)
+	// Check equality.
+	if op.Key != marshalledOp.Key {
+		t.Fatalf("Keys not equal. Original: %s Roundtripped: %s", op.Key, marshalledOp.Key)
+	}
+	if len(op.Params) != roundtripped.Len() {
+		t.Fatalf("Operations do not contain equal numbers of parameters. Original: %d Roundtripped: %d",
+			len(op.Params), roundtripped.Len())
+	}
+	// Each parameter should decode back into its original type.
+	var (
+		roundtrippedInt     int
+		roundtrippedFloat   float64
+		roundtrippedString  string
+		roundtrippedInteger integer
+	)
+	for index, v := range []interface{}{
+		&roundtrippedInt, &roundtrippedFloat, &roundtrippedString, &roundtrippedInteger,
+	} {
+		err = roundtripped.Decode(index, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if roundtrippedInt != op.Params[0] {
+		t.Fatalf("Parameter 0 not equal. Original: %d Roundtripped: %d",
+			op.Params[0], roundtrippedInt)
+	}
+	if roundtrippedFloat != op.Params[1] {
+		t.Fatalf("Parameter 1 not equal. Original: %f Roundtripped: %f",
+			op.Params[1], roundtrippedFloat)
+	}
+	if roundtrippedString != op.Params[2] {
+		t.Fatalf("Parameter 2 not equal. Original: %s Roundtripped: %s",
+			op.Params[2], roundtrippedString)
+	}
+	if roundtrippedInteger != op.Params[3] {
+		t.Fatalf("Parameter 3 not equal. Original: %v Roundtripped: %v",
+			op.Params[3], roundtrippedInteger)
+	}
+	// Decoding past the end of the parameters should fail.
+	if roundtripped.Decode(len(params), &roundtrippedInt) == nil {
+		t.Fatal("Expected error decoding non-existent parameter")
 	}
-	indexToReplace := ints[0]
-	replacement := ints[1]
-	(*slicePtr)[indexToReplace] = replacement
-	return nil
 }
 
-func doTypeAssertions(expectedLength int, params []interface{}) (*[]int, []int, error) {
-	if len(params) != expectedLength {
-		return nil, nil, fmt.Errorf("Received %d parameters; expected %d", len(params), expectedLength)
+// -- Helper functions --
+
+func appendOperation(slicePtr *[]int) Handler {
+	return func(params Params) error {
+		ints, err := decodeInts(1, params)
+		if err != nil {
+			return err
+		}
+		*slicePtr = append(*slicePtr, ints[0])
+		return nil
 	}
-	slice, ok := params[0].(*[]int)
-	if !ok {
-		return nil, nil, fmt.Errorf("Received parameter of type %T; expected *[]int", params[0])
+}
+
+func deleteOperation(slicePtr *[]int) Handler {
+	return func(params Params) error {
+		ints, err := decodeInts(1, params)
+		if err != nil {
+			return err
+		}
+		indexToDelete := ints[0]
+		*slicePtr = append((*slicePtr)[:indexToDelete], (*slicePtr)[indexToDelete+1:]...)
+		return nil
 	}
-	var ints []int
-	for _, param := range params[1:] {
-		i, ok := param.(float64)
-		if !ok {
-			return nil, nil, fmt.Errorf("Received paramater of type %T; expected float64", params[1])
+}
+
+func replaceOperation(slicePtr *[]int) Handler {
+	return func(params Params) error {
+		ints, err := decodeInts(2, params)
+		if err != nil {
+			return err
 		}
-		ints = append(ints, int(i))
+		indexToReplace := ints[0]
+		replacement := ints[1]
+		(*slicePtr)[indexToReplace] = replacement
+		return nil
 	}
-	return slice, ints, nil
 }
 
-// Binds the input parameters to the closure.
-func bind(closure func(...interface{}) error, params ...interface{}) func(...interface{}) error {
-	return func(unboundParams ...interface{}) error {
-		return closure(append(params, unboundParams...)...)
+func decodeInts(expectedLength int, params Params) ([]int, error) {
+	if err := params.Expect(expectedLength); err != nil {
+		return nil, err
+	}
+	ints := make([]int, expectedLength)
+	for index := range ints {
+		if err := params.Decode(index, &ints[index]); err != nil {
+			return nil, err
+		}
 	}
+	return ints, nil
 }
 
 func slicesEqual(slice1, slice2 []int) bool {
@@ -324,6 +824,21 @@ func slicesEqual(slice1, slice2 []int) bool {
 	return true
 }
 
+// Waits for a compaction running in the background to finish.
+func waitForCompaction(l *Log) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.finishCompaction(true)
+}
+
+// Removes a log file and its lock file.
+func removeLogFiles(path string) {
+	os.Remove(path)
+	os.Remove(path + ".lock")
+	os.Remove(snapshotPath(path))
+	os.Remove(previousTailPath(path))
+}
+
 // Helper function for easier querying of file size.
 func size(f *os.File) int64 {
 	info, err := f.Stat()
@@ -0,0 +1,38 @@
+package persisted
+
+import (
+	"context"
+	"log/slog"
+)
+
+// WithLogger sets a logger to receive structured events from the log: replay
+// progress, the start and end of compactions, compaction policy decisions,
+// segment rollovers, and recovery from damage such as an incompletely written
+// record. Events carry the log's path as the "path" attribute. Nothing is
+// logged by default.
+//
+// Events never include operation parameters, which may hold user data.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// The number of operations between replay progress events.
+const replayProgressInterval = 100000
+
+// A slog.Handler which drops everything, used when no logger is set.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// Returns the logger for a log at the given path.
+func newLogger(o *options, path string) *slog.Logger {
+	if o.logger == nil {
+		return slog.New(discardHandler{})
+	}
+	return o.logger.With("path", path)
+}
@@ -0,0 +1,76 @@
+package persisted
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	const secret = "a secret element"
+	tf, err := ioutil.TempFile("", "temp-testing")
+	defer removeLogFiles(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll, err := NewLinkedList[string](tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = ll.Append(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave half a record at the end of the file for replay to discard.
+	f, err := os.OpenFile(tf.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte{0, 0, 0})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ll, err = NewLinkedList[string](tf.Name(), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ll.Compact()
+	if err == nil {
+		err = ll.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := buf.String()
+	for _, event := range []string{
+		"replay started",
+		"replay finished",
+		"discarded incompletely written record",
+		"compaction started",
+		"compaction finished",
+	} {
+		if !strings.Contains(output, `"msg":"`+event+`"`) {
+			t.Errorf("Expected event %q in log output:\n%s", event, output)
+		}
+	}
+	if !strings.Contains(output, `"path":"`+tf.Name()+`"`) {
+		t.Errorf("Expected log path in log output:\n%s", output)
+	}
+	if strings.Contains(output, secret) {
+		t.Fatalf("Operation parameters leaked into log output:\n%s", output)
+	}
+}
@@ -0,0 +1,261 @@
+package persisted
+
+import (
+	"fmt"
+	"iter"
+	"maps"
+	"sync"
+)
+
+// Operations we record in the log file.
+const (
+	_set    = "__set__"
+	_delete = "__delete__"
+)
+
+// Map is a persisted map from keys of type K to values of type V. Keys and
+// values are recorded using the log's Codec and are decoded directly back into
+// K and V on replay. Initialize a Map by calling NewMap.
+//
+// A Map is safe for concurrent use. Reads may proceed in parallel, while
+// modifications are serialized.
+type Map[K comparable, V any] struct {
+	// Guards inner, in the same way as LinkedList.mu.
+	mu    *sync.RWMutex
+	inner map[K]V
+	log   *Log
+	// As for LinkedList.
+	store  *Store
+	prefix string
+}
+
+// NewMap returns a new Map anchored to the file specified by the input
+// filepath.
+//
+// If this file exists and is not empty, it is assumed that the file represents
+// a persisted Map of the same key and value types and the data structure will
+// be re-constructed. If this file does not exist or is empty, a new, empty Map
+// will be created. In this case, a new file may be created by this
+// constructor, but all parent directories must already exist.
+//
+// The options configure the underlying log.
+func NewMap[K comparable, V any](filepath string, opts ...Option) (m *Map[K, V], err error) {
+	m = newMap[K, V](new(sync.RWMutex))
+	m.log, err = NewLog(filepath, m.getCallback(), append(opts, WithType("map"))...)
+	if err != nil {
+		return nil, err
+	}
+	err = m.log.Replay(m.getOperationsMap())
+	if err != nil {
+		m.log.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Returns an empty map guarded by mu.
+func newMap[K comparable, V any](mu *sync.RWMutex) *Map[K, V] {
+	return &Map[K, V]{mu: mu, inner: make(map[K]V)}
+}
+
+// Set associates the value with the key, replacing any existing value.
+func (m *Map[K, V]) Set(key K, value V) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.change(func(tx *MapTx[K, V]) error { return tx.Set(key, value) })
+}
+
+// Get returns the value associated with the key. The boolean is false if there
+// is no such value.
+func (m *Map[K, V]) Get(key K) (V, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.inner[key]
+	return value, ok
+}
+
+// Delete removes the key and its value from the map. Deleting a key which is
+// not in the map is a no-op.
+func (m *Map[K, V]) Delete(key K) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.change(func(tx *MapTx[K, V]) error { return tx.Delete(key) })
+}
+
+// Close flushes the map to stable storage and releases its file. The map can
+// still be read after it is closed, but any attempt to modify it returns
+// ErrClosed. Closing a map opened from a Store closes the Store.
+func (m *Map[K, V]) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.log.Close()
+}
+
+// Len returns the number of keys in the map.
+func (m *Map[K, V]) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.inner)
+}
+
+// Keys returns the keys in the map, in no particular order.
+func (m *Map[K, V]) Keys() []K {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]K, 0, len(m.inner))
+	for key := range m.inner {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// All returns an iterator over the keys and values in the map, in no
+// particular order. It works from a snapshot of the map taken when the
+// iteration begins, so the loop body and other goroutines are free to modify
+// the map meanwhile.
+func (m *Map[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		m.mu.RLock()
+		snapshot := maps.Clone(m.inner)
+		m.mu.RUnlock()
+		for key, value := range snapshot {
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// Sync flushes every change made to the map so far to stable storage,
+// regardless of the SyncPolicy the map was created with.
+func (m *Map[K, V]) Sync() error {
+	return m.log.Sync()
+}
+
+// Compact compacts the map's log now, whatever the CompactionPolicy it was
+// created with.
+func (m *Map[K, V]) Compact() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.log.Compact()
+}
+
+// In returns a view of the map, which must have been opened from the Store
+// running tx, through which the function passed to Store.Update can modify it.
+func (m *Map[K, V]) In(tx *StoreTx) *MapTx[K, V] {
+	tx.check(m.store)
+	return m.tx(tx.t)
+}
+
+func (m *Map[K, V]) tx(t *transaction) *MapTx[K, V] {
+	return &MapTx[K, V]{inner: m.inner, prefix: m.prefix, t: t}
+}
+
+// Calls fn with a new transaction and records the changes it makes in the log,
+// as LinkedList.change does. m.mu must be held.
+func (m *Map[K, V]) change(fn func(tx *MapTx[K, V]) error) error {
+	if err := m.log.checkWritable(); err != nil {
+		return err
+	}
+	tx := m.tx(new(transaction))
+	return tx.t.run(m.log, func() error { return fn(tx) })
+}
+
+// MapTx is a Map's part in a Store transaction. Its methods behave like those
+// of the Map, and see the changes made so far in the transaction.
+type MapTx[K comparable, V any] struct {
+	inner  map[K]V
+	prefix string
+	t      *transaction
+}
+
+// Set associates the value with the key, replacing any existing value.
+func (tx *MapTx[K, V]) Set(key K, value V) error {
+	if tx.t.done {
+		return ErrTxDone
+	}
+	tx.t.record(tx.restorer(key), tx.prefix+_set, key, value)
+	tx.inner[key] = value
+	return nil
+}
+
+// Get returns the value associated with the key. The boolean is false if there
+// is no such value.
+func (tx *MapTx[K, V]) Get(key K) (V, bool) {
+	value, ok := tx.inner[key]
+	return value, ok
+}
+
+// Delete removes the key and its value from the map. Deleting a key which is
+// not in the map is a no-op.
+func (tx *MapTx[K, V]) Delete(key K) error {
+	if tx.t.done {
+		return ErrTxDone
+	}
+	if _, ok := tx.inner[key]; !ok {
+		return nil
+	}
+	tx.t.record(tx.restorer(key), tx.prefix+_delete, key)
+	delete(tx.inner, key)
+	return nil
+}
+
+// Len returns the number of keys in the map.
+func (tx *MapTx[K, V]) Len() int {
+	return len(tx.inner)
+}
+
+// Returns a function which puts the key back as it is now.
+func (tx *MapTx[K, V]) restorer(key K) func() {
+	value, ok := tx.inner[key]
+	return func() {
+		if ok {
+			tx.inner[key] = value
+		} else {
+			delete(tx.inner, key)
+		}
+	}
+}
+
+// Returns a callback function for the map which can be passed into the NewLog
+// function. The compacted form of a map is one set operation per key. As with
+// LinkedList, the callback runs with m.mu already held and must not lock.
+func (m *Map[K, V]) getCallback() SnapshotFunc {
+	return func() []Operation {
+		ops := make([]Operation, 0, len(m.inner))
+		for key, value := range m.inner {
+			ops = append(ops, NewOperation(_set, key, value))
+		}
+		return ops
+	}
+}
+
+func (m *Map[K, V]) getOperationsMap() map[string]Handler {
+	opsMap := make(map[string]Handler)
+	opsMap[_set] = func(params Params) error {
+		if err := params.Expect(2); err != nil {
+			return err
+		}
+		var (
+			key   K
+			value V
+		)
+		if err := params.Decode(0, &key); err != nil {
+			return fmt.Errorf("Error decoding key: %w", err)
+		}
+		if err := params.Decode(1, &value); err != nil {
+			return fmt.Errorf("Error decoding value: %w", err)
+		}
+		m.inner[key] = value
+		return nil
+	}
+	opsMap[_delete] = func(params Params) error {
+		key, err := decodeElement[K](params)
+		if err != nil {
+			return fmt.Errorf("Error decoding key: %w", err)
+		}
+		delete(m.inner, key)
+		return nil
+	}
+	return opsMap
+}
@@ -0,0 +1,125 @@
+package persisted
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestMapSetGetDelete(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewMap[string, integer](newLogFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for i, key := range []string{"a", "b", "c"} {
+		err = m.Set(key, integer{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Overwrite one key and delete another.
+	err = m.Set("a", integer{100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Delete("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deleting a missing key is a no-op.
+	err = m.Delete("not a key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Len() != 2 {
+		t.Fatalf("Expected 2 keys; got %d", m.Len())
+	}
+	if value, ok := m.Get("a"); !ok || value.WrappedInt != 100 {
+		t.Errorf("Expected a=100; got %v, %t", value, ok)
+	}
+	if _, ok := m.Get("b"); ok {
+		t.Error("Deleted key b should not be present")
+	}
+	if value, ok := m.Get("c"); !ok || value.WrappedInt != 2 {
+		t.Errorf("Expected c=2; got %v, %t", value, ok)
+	}
+	keys := m.Keys()
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "c" {
+		t.Errorf("Expected keys [a c]; got %v", keys)
+	}
+	ranged := make(map[string]integer)
+	for key, value := range m.All() {
+		ranged[key] = value
+	}
+	if len(ranged) != 2 || ranged["a"].WrappedInt != 100 || ranged["c"].WrappedInt != 2 {
+		t.Errorf("All visited unexpected entries: %v", ranged)
+	}
+	visited := 0
+	for range m.All() {
+		visited++
+		break
+	}
+	if visited != 1 {
+		t.Errorf("All should stop when the loop breaks; visited %d entries", visited)
+	}
+
+	// The map can be modified during the iteration, which doesn't see the
+	// changes.
+	visited = 0
+	for key := range m.All() {
+		visited++
+		if err := m.Set(key+key, integer{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if visited != 2 || m.Len() != 4 {
+		t.Errorf("Expected 2 entries visited and 4 after; visited %d and have %d", visited, m.Len())
+	}
+}
+
+func TestMapPersistence(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewMap[int, integer](newLogFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// Enough churn to trigger compaction along the way.
+	m.log.compactionPolicy = CompactAtSize(1024)
+	for i := 0; i < 1000; i++ {
+		err = m.Set(i%10, integer{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			err = m.Delete(i % 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mJr, err := NewMap[int, integer](m.log.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mJr.Len() != m.Len() {
+		t.Fatalf("Map loaded from file has %d keys; expected %d", mJr.Len(), m.Len())
+	}
+	for key, value := range m.All() {
+		if loaded, ok := mJr.Get(key); !ok || loaded != value {
+			t.Errorf("Key %d: expected %v; loaded %v, %t", key, value, loaded, ok)
+		}
+	}
+}
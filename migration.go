@@ -0,0 +1,47 @@
+package persisted
+
+import "fmt"
+
+// Migration rewrites an operation recorded at one schema version into the
+// form expected at the next. It receives the operation's key and its
+// parameters as marshalled by the log's Codec, and returns the rewritten
+// parameters.
+type Migration func(key string, params [][]byte) ([][]byte, error)
+
+// Migrations is a registry of migrations, keyed by the schema version each
+// migrates from.
+type Migrations map[uint64]Migration
+
+// WithSchema sets the schema version of the operations in the log, which is
+// recorded in the file header. This should be increased whenever the
+// operations change in a way the Codec can't cope with, such as a change to
+// the shape of the elements of a structure.
+//
+// When Replay meets operations recorded at an older version, each is passed
+// through the migrations from its version up to the current one before its
+// Handler sees it. Once replayed, a migrated log is compacted so that it is
+// rewritten at the current version. Opening a log recorded at a newer version
+// fails with ErrIncompatible. The default version is 0.
+func WithSchema(version uint64, migrations Migrations) Option {
+	return func(o *options) {
+		o.schema = version
+		o.migrations = migrations
+	}
+}
+
+// Migrates an operation recorded at the given schema version to the current
+// version. l.mu must be held.
+func (l *Log) migrate(schema uint64, marshalledOp marshalledOperation) (marshalledOperation, error) {
+	for version := schema; version < l.options.schema; version++ {
+		migration, ok := l.options.migrations[version]
+		if !ok {
+			return marshalledOp, fmt.Errorf("No migration from schema version %d", version)
+		}
+		params, err := migration(marshalledOp.Key, marshalledOp.MarshalledParameters)
+		if err != nil {
+			return marshalledOp, fmt.Errorf("Error migrating operation from schema version %d: %w", version, err)
+		}
+		marshalledOp.MarshalledParameters = params
+	}
+	return marshalledOp, nil
+}
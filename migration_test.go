@@ -0,0 +1,102 @@
+package persisted
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+type personV0 struct {
+	Name string
+}
+
+type personV1 struct {
+	First, Last string
+}
+
+// Splits the name of a personV0 into the fields of a personV1.
+func splitName(key string, params [][]byte) ([][]byte, error) {
+	migrated := make([][]byte, len(params))
+	for i, param := range params {
+		var old personV0
+		err := json.Unmarshal(param, &old)
+		if err != nil {
+			return nil, err
+		}
+		var person personV1
+		for j, c := range old.Name {
+			if c == ' ' {
+				person.First, person.Last = old.Name[:j], old.Name[j+1:]
+				break
+			}
+		}
+		migrated[i], err = json.Marshal(person)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return migrated, nil
+}
+
+func TestMigrations(t *testing.T) {
+	tf, err := ioutil.TempFile("", "temp-testing")
+	defer removeLogFiles(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := NewLinkedList[personV0](tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Ada Lovelace", "Alan Turing"} {
+		err = old.Append(personV0{name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewLinkedList[personV1](tf.Name(), WithSchema(1, nil))
+	if err == nil {
+		t.Fatal("Expected an error replaying without a migration")
+	}
+
+	migrations := Migrations{0: splitName}
+	ll, err := NewLinkedList[personV1](tf.Name(), WithSchema(1, migrations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := ll.Get(0)
+	second, _ := ll.Get(1)
+	if first != (personV1{"Ada", "Lovelace"}) || second != (personV1{"Alan", "Turing"}) {
+		t.Fatalf("Unexpected migrated elements %v and %v", first, second)
+	}
+	if ll.log.header.Schema != 1 {
+		t.Fatalf("Expected the log to be rewritten at schema version 1; header has %d", ll.log.header.Schema)
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The log no longer needs migrating, and older code can't read it.
+	ll, err = NewLinkedList[personV1](tf.Name(), WithSchema(1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ll.Length() != 2 {
+		t.Fatalf("Expected 2 elements; got %d", ll.Length())
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewLinkedList[personV0](tf.Name())
+	if !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Expected ErrIncompatible opening a log with a newer schema; got %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package persisted
+
+import "log/slog"
+
+// Option configures a Log, or a data structure built on one. Options passed to
+// a data structure's constructor are handed on to its log.
+type Option func(*options)
+
+type options struct {
+	codec          Codec
+	format         Format
+	sync           SyncPolicy
+	compactOnClose bool
+	readOnly       bool
+	structureType  string
+	snapshots      bool
+	compaction     CompactionPolicy
+	segmentSize    int64
+	unknown        UnknownOperationPolicy
+	schema         uint64
+	migrations     Migrations
+	logger         *slog.Logger
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		codec:      JSON,
+		sync:       SyncNever,
+		compaction: CompactAtRatio(2, 10*1024),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithSync sets the policy used to flush appended operations to stable storage.
+// The default is SyncNever.
+func WithSync(policy SyncPolicy) Option {
+	return func(o *options) {
+		o.sync = policy
+	}
+}
+
+// WithCompactOnClose sets whether the log is compacted when it is closed, so
+// that the next replay is as fast as possible. The default is false.
+func WithCompactOnClose(compact bool) Option {
+	return func(o *options) {
+		o.compactOnClose = compact
+	}
+}
+
+// WithReadOnly opens the log for reading only. A read-only log can be replayed
+// while another process has the same log open for writing, but it cannot be
+// appended to or compacted, and an incomplete final record is skipped rather
+// than truncated away.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
@@ -0,0 +1,367 @@
+package persisted
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Operations we record in the log file.
+const (
+	_enqueue = "__enqueue__"
+	_dequeue = "__dequeue__"
+	_ack     = "__ack__"
+	_nack    = "__nack__"
+)
+
+// Queue is a persisted FIFO queue with at-least-once delivery. Dequeue hands
+// out an element under a Lease which must be acknowledged with Ack once the
+// element has been dealt with. Elements which are dequeued but never
+// acknowledged, including those outstanding when the process stops, are
+// delivered again. Initialize a Queue by calling NewQueue.
+//
+// A Queue is safe for concurrent use.
+type Queue[T any] struct {
+	// Guards everything below, in the same way as LinkedList.mu.
+	mu       *sync.RWMutex
+	pending  *inMemLinkedList[queueItem[T]]
+	inFlight map[uint64]T
+	nextID   uint64
+	log      *Log
+	// As for LinkedList.
+	store  *Store
+	prefix string
+}
+
+// Lease is a dequeued element, identified by ID until it is acknowledged.
+type Lease[T any] struct {
+	ID    uint64
+	Value T
+}
+
+type queueItem[T any] struct {
+	id    uint64
+	value T
+}
+
+// NewQueue returns a new Queue anchored to the file specified by the input
+// filepath.
+//
+// If this file exists and is not empty, it is assumed that the file represents
+// a persisted Queue of the same element type and the data structure will be
+// re-constructed. Any elements which were dequeued but not acknowledged are
+// returned to the front of the queue, in their original order. If this file
+// does not exist or is empty, a new, empty Queue will be created. In this case,
+// a new file may be created by this constructor, but all parent directories
+// must already exist.
+//
+// The options configure the underlying log.
+func NewQueue[T any](filepath string, opts ...Option) (q *Queue[T], err error) {
+	q = newQueue[T](new(sync.RWMutex))
+	q.log, err = NewLog(filepath, q.getCallback(), append(opts, WithType("queue"))...)
+	if err != nil {
+		return nil, err
+	}
+	err = q.log.Replay(q.getOperationsMap())
+	if err != nil {
+		q.log.Close()
+		return nil, err
+	}
+	err = q.redeliver()
+	if err != nil {
+		q.log.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Returns an empty queue guarded by mu.
+func newQueue[T any](mu *sync.RWMutex) *Queue[T] {
+	return &Queue[T]{
+		mu:       mu,
+		pending:  new(inMemLinkedList[queueItem[T]]),
+		inFlight: make(map[uint64]T),
+	}
+}
+
+// Returns the elements which were in flight when the queue was loaded to the
+// front of the queue, since nobody holds their leases any more. q.mu must be
+// held, or the queue not yet shared.
+func (q *Queue[T]) redeliver() error {
+	if q.log.readOnly {
+		return nil
+	}
+	// We push in reverse order so that the oldest ends up at the front.
+	ids := q.inFlightIDs()
+	return q.change(func(tx *QueueTx[T]) error {
+		for i := len(ids) - 1; i >= 0; i-- {
+			if err := tx.Nack(ids[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Enqueue adds the input element to the back of the queue.
+func (q *Queue[T]) Enqueue(newElement T) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.change(func(tx *QueueTx[T]) error { return tx.Enqueue(newElement) })
+}
+
+// Dequeue removes the element at the front of the queue and returns it under a
+// new lease. The element will be delivered again unless the lease is passed to
+// Ack. Returns ErrEmpty if there are no elements waiting.
+func (q *Queue[T]) Dequeue() (lease Lease[T], err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err = q.change(func(tx *QueueTx[T]) (err error) {
+		lease, err = tx.Dequeue()
+		return
+	})
+	return
+}
+
+// Ack acknowledges that the element leased under the input ID has been dealt
+// with, removing it from the queue for good. Returns ErrUnknownLease if there
+// is no such outstanding lease.
+func (q *Queue[T]) Ack(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.change(func(tx *QueueTx[T]) error { return tx.Ack(id) })
+}
+
+// Nack gives up the lease with the input ID, returning its element to the front
+// of the queue so that it is the next one dequeued. Returns ErrUnknownLease if
+// there is no such outstanding lease.
+func (q *Queue[T]) Nack(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.change(func(tx *QueueTx[T]) error { return tx.Nack(id) })
+}
+
+// Close flushes the queue to stable storage and releases its file. Any attempt
+// to modify the queue after it is closed returns ErrClosed. Elements still in
+// flight will be redelivered when the queue is next loaded. Closing a queue
+// opened from a Store closes the Store.
+func (q *Queue[T]) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.log.Close()
+}
+
+// Len returns the number of elements waiting to be dequeued.
+func (q *Queue[T]) Len() int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.pending.length
+}
+
+// InFlight returns the number of elements which have been dequeued but not yet
+// acknowledged.
+func (q *Queue[T]) InFlight() int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return len(q.inFlight)
+}
+
+// Sync flushes every change made to the queue so far to stable storage,
+// regardless of the SyncPolicy the queue was created with.
+func (q *Queue[T]) Sync() error {
+	return q.log.Sync()
+}
+
+// Compact compacts the queue's log now, whatever the CompactionPolicy it was
+// created with.
+func (q *Queue[T]) Compact() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.log.Compact()
+}
+
+// In returns a view of the queue, which must have been opened from the Store
+// running tx, through which the function passed to Store.Update can modify it.
+func (q *Queue[T]) In(tx *StoreTx) *QueueTx[T] {
+	tx.check(q.store)
+	return &QueueTx[T]{q: q, t: tx.t}
+}
+
+// Calls fn with a new transaction and records the changes it makes in the log,
+// as LinkedList.change does. q.mu must be held.
+func (q *Queue[T]) change(fn func(tx *QueueTx[T]) error) error {
+	if err := q.log.checkWritable(); err != nil {
+		return err
+	}
+	tx := &QueueTx[T]{q: q, t: new(transaction)}
+	return tx.t.run(q.log, func() error { return fn(tx) })
+}
+
+// QueueTx is a Queue's part in a Store transaction. Its methods behave like
+// those of the Queue, and see the changes made so far in the transaction.
+type QueueTx[T any] struct {
+	q *Queue[T]
+	t *transaction
+}
+
+// Enqueue adds the input element to the back of the queue.
+func (tx *QueueTx[T]) Enqueue(newElement T) error {
+	if tx.t.done {
+		return ErrTxDone
+	}
+	q := tx.q
+	id := q.nextID
+	q.nextID++
+	q.pending.append(queueItem[T]{id, newElement})
+	tx.t.record(func() {
+		q.pending.pop()
+		q.nextID--
+	}, q.prefix+_enqueue, id, newElement)
+	return nil
+}
+
+// Dequeue removes the element at the front of the queue and returns it under a
+// new lease. Returns ErrEmpty if there are no elements waiting.
+func (tx *QueueTx[T]) Dequeue() (Lease[T], error) {
+	if tx.t.done {
+		return Lease[T]{}, ErrTxDone
+	}
+	q := tx.q
+	item, ok := q.pending.shift()
+	if !ok {
+		return Lease[T]{}, ErrEmpty
+	}
+	q.inFlight[item.id] = item.value
+	tx.t.record(func() {
+		delete(q.inFlight, item.id)
+		q.pending.push(item)
+	}, q.prefix+_dequeue, item.id)
+	return Lease[T]{item.id, item.value}, nil
+}
+
+// Ack acknowledges that the element leased under the input ID has been dealt
+// with. Returns ErrUnknownLease if there is no such outstanding lease.
+func (tx *QueueTx[T]) Ack(id uint64) error {
+	if tx.t.done {
+		return ErrTxDone
+	}
+	q := tx.q
+	value, ok := q.inFlight[id]
+	if !ok {
+		return ErrUnknownLease
+	}
+	delete(q.inFlight, id)
+	tx.t.record(func() { q.inFlight[id] = value }, q.prefix+_ack, id)
+	return nil
+}
+
+// Nack gives up the lease with the input ID, returning its element to the front
+// of the queue. Returns ErrUnknownLease if there is no such outstanding lease.
+func (tx *QueueTx[T]) Nack(id uint64) error {
+	if tx.t.done {
+		return ErrTxDone
+	}
+	q := tx.q
+	value, ok := q.inFlight[id]
+	if !ok {
+		return ErrUnknownLease
+	}
+	delete(q.inFlight, id)
+	q.pending.push(queueItem[T]{id, value})
+	tx.t.record(func() {
+		q.pending.shift()
+		q.inFlight[id] = value
+	}, q.prefix+_nack, id)
+	return nil
+}
+
+// Len returns the number of elements waiting to be dequeued.
+func (tx *QueueTx[T]) Len() int {
+	return tx.q.pending.length
+}
+
+// Returns the IDs of all outstanding leases, oldest first.
+func (q *Queue[T]) inFlightIDs() []uint64 {
+	ids := make([]uint64, 0, len(q.inFlight))
+	for id := range q.inFlight {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Returns a callback function for the queue which can be passed into the NewLog
+// function. Elements which are in flight are recorded as enqueued and then
+// immediately dequeued so that they can still be acknowledged. As with
+// LinkedList, the callback runs with q.mu already held and must not lock.
+func (q *Queue[T]) getCallback() SnapshotFunc {
+	return func() []Operation {
+		ops := make([]Operation, 0, 2*len(q.inFlight)+q.pending.length)
+		for _, id := range q.inFlightIDs() {
+			ops = append(ops, NewOperation(_enqueue, id, q.inFlight[id]), NewOperation(_dequeue, id))
+		}
+		iter := q.pending.iterator()
+		for item, ok := iter(); ok; item, ok = iter() {
+			ops = append(ops, NewOperation(_enqueue, item.id, item.value))
+		}
+		return ops
+	}
+}
+
+func (q *Queue[T]) getOperationsMap() map[string]Handler {
+	opsMap := make(map[string]Handler)
+	opsMap[_enqueue] = func(params Params) error {
+		if err := params.Expect(2); err != nil {
+			return err
+		}
+		var item queueItem[T]
+		if err := params.Decode(0, &item.id); err != nil {
+			return err
+		}
+		if err := params.Decode(1, &item.value); err != nil {
+			return err
+		}
+		q.pending.append(item)
+		if item.id >= q.nextID {
+			q.nextID = item.id + 1
+		}
+		return nil
+	}
+	opsMap[_dequeue] = func(params Params) error {
+		id, err := decodeElement[uint64](params)
+		if err != nil {
+			return err
+		}
+		item, ok := q.pending.shift()
+		if !ok || item.id != id {
+			return fmt.Errorf("%w: dequeue of element %d does not match front of queue", ErrCorrupt, id)
+		}
+		q.inFlight[id] = item.value
+		return nil
+	}
+	opsMap[_ack] = func(params Params) error {
+		id, err := decodeElement[uint64](params)
+		if err != nil {
+			return err
+		}
+		if _, ok := q.inFlight[id]; !ok {
+			return fmt.Errorf("%w: ack of element %d which is not in flight", ErrCorrupt, id)
+		}
+		delete(q.inFlight, id)
+		return nil
+	}
+	opsMap[_nack] = func(params Params) error {
+		id, err := decodeElement[uint64](params)
+		if err != nil {
+			return err
+		}
+		value, ok := q.inFlight[id]
+		if !ok {
+			return fmt.Errorf("%w: nack of element %d which is not in flight", ErrCorrupt, id)
+		}
+		delete(q.inFlight, id)
+		q.pending.push(queueItem[T]{id, value})
+		return nil
+	}
+	return opsMap
+}
@@ -0,0 +1,140 @@
+package persisted
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQueueOrderAndAck(t *testing.T) {
+	t.Parallel()
+
+	q, err := NewQueue[integer](newLogFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for i := 0; i < 5; i++ {
+		err = q.Enqueue(integer{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Elements come out in the order they went in. The first time we see 1 we
+	// give it back, so it should be dequeued again straight away.
+	nacked := false
+	for _, expected := range []int{0, 1, 1, 2, 3, 4} {
+		lease, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease.Value.WrappedInt != expected {
+			t.Fatalf("Expected %d; got %d", expected, lease.Value.WrappedInt)
+		}
+		if expected == 1 && !nacked {
+			err = q.Nack(lease.ID)
+			nacked = true
+		} else {
+			err = q.Ack(lease.ID)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Ack(lease.ID); !errors.Is(err, ErrUnknownLease) {
+			t.Fatalf("Expected ErrUnknownLease for a lease already given up; got %v", err)
+		}
+	}
+	if _, err = q.Dequeue(); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("Expected ErrEmpty from empty queue; got %v", err)
+	}
+}
+
+// Elements dequeued but not acknowledged before a restart should be delivered
+// again, ahead of everything else and in their original order.
+func TestQueueRedelivery(t *testing.T) {
+	t.Parallel()
+
+	q, err := NewQueue[int](newLogFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for i := 0; i < 10; i++ {
+		err = q.Enqueue(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Ack 0 and 2, leave 1 and 3 outstanding.
+	var leases []Lease[int]
+	for i := 0; i < 4; i++ {
+		lease, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		leases = append(leases, lease)
+	}
+	for _, i := range []int{0, 2} {
+		err = q.Ack(leases[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Compact with elements in flight, then ack one of them afterwards.
+	lease, err := q.Dequeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.log.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.Ack(lease.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "Restart" by loading a new queue from the same file.
+	err = q.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	qJr, err := NewQueue[int](q.log.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qJr.InFlight() != 0 {
+		t.Fatalf("Expected no elements in flight after restart; got %d", qJr.InFlight())
+	}
+	var got []int
+	for {
+		lease, err := qJr.Dequeue()
+		if errors.Is(err, ErrEmpty) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, lease.Value)
+		err = qJr.Ack(lease.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !slicesEqual(got, []int{1, 3, 5, 6, 7, 8, 9}) {
+		t.Fatalf("Unexpected elements after restart: %v", got)
+	}
+
+	// Everything has been acknowledged, so a third queue should be empty.
+	err = qJr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	qTheThird, err := NewQueue[int](qJr.log.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qTheThird.Len() != 0 || qTheThird.InFlight() != 0 {
+		t.Fatalf("Expected empty queue; %d waiting and %d in flight", qTheThird.Len(), qTheThird.InFlight())
+	}
+}
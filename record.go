@@ -0,0 +1,157 @@
+package persisted
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Each operation is written to the log as a framed record:
+//
+//	+-----------------+-----------------+-----------------+--------------------+
+//	| length (uint32) | CRC32C (uint32) | CRC32C (uint32) | payload (length B) |
+//	+-----------------+-----------------+-----------------+--------------------+
+//
+// All header fields are big-endian. The first checksum covers the length and
+// the second the payload. The framing lets us tell a record which was only
+// partially written (because the process died mid-write) from one which was
+// corrupted after the fact. Checking the length before trusting it means a
+// damaged length can't pass for a record running off the end of the file.
+
+const recordHeaderSize = 12
+
+// The largest payload we'll write or read. Anything larger in the length field
+// can't have come from us, so it is treated as corruption.
+const maxRecordSize = 64 * 1024 * 1024
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Returns the payload framed as a record.
+func frameRecord(payload []byte) ([]byte, error) {
+	if len(payload) > maxRecordSize {
+		return nil, fmt.Errorf("Record of %d bytes exceeds maximum size of %d bytes",
+			len(payload), maxRecordSize)
+	}
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(record[0:4], castagnoli))
+	binary.BigEndian.PutUint32(record[8:12], crc32.Checksum(payload, castagnoli))
+	copy(record[recordHeaderSize:], payload)
+	return record, nil
+}
+
+// Reads framed records from a log file.
+type recordReader struct {
+	reader *bufio.Reader
+	// The offset of the next record.
+	offset int64
+	// The total size of the file being read.
+	size int64
+}
+
+// Returns a reader for the records in r, which must be positioned at offset
+// within a file of the given size.
+func newRecordReader(r io.Reader, offset, size int64) *recordReader {
+	return &recordReader{bufio.NewReader(r), offset, size}
+}
+
+// Errors returned by recordReader.next when the tail of the file holds a
+// record that was never completely written.
+type tornRecordError struct {
+	offset int64
+	reason string
+}
+
+func (e *tornRecordError) Error() string {
+	return fmt.Sprintf("Torn record at offset %d: %s", e.offset, e.reason)
+}
+
+// Returns the payload of the next record. Returns io.EOF when there are no more
+// records, a *tornRecordError if the final record in the file is incomplete,
+// or an error wrapping ErrCorrupt if a record is damaged. A record only counts
+// as incomplete if the file ends before it does, or if it is the last record
+// and its payload is damaged; its length must be intact either way.
+func (rr *recordReader) next() ([]byte, error) {
+	var header [recordHeaderSize]byte
+	n, err := io.ReadFull(rr.reader, header[:])
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, &tornRecordError{rr.offset, fmt.Sprintf("only %d header bytes", n)}
+	} else if err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(header[0:4], castagnoli) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("%w: damaged length in record at offset %d", ErrCorrupt, rr.offset)
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[8:12])
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("%w: record at offset %d claims %d bytes", ErrCorrupt, rr.offset, length)
+	}
+	payload := make([]byte, length)
+	n, err = io.ReadFull(rr.reader, payload)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, &tornRecordError{rr.offset, fmt.Sprintf("only %d of %d payload bytes", n, length)}
+	} else if err != nil {
+		return nil, err
+	}
+	end := rr.offset + recordHeaderSize + int64(length)
+	if crc32.Checksum(payload, castagnoli) != checksum {
+		if end == rr.size {
+			// The last record in the file: most likely a write which did not make it
+			// to disk in its entirety.
+			return nil, &tornRecordError{rr.offset, "checksum mismatch"}
+		}
+		return nil, fmt.Errorf("%w: checksum mismatch in record at offset %d", ErrCorrupt, rr.offset)
+	}
+	rr.offset = end
+	return payload, nil
+}
+
+// Reads the operations from a log file written before records were framed and
+// the file header was introduced. Such a file holds one JSON-encoded
+// marshalledOperation per line.
+type legacyReader struct {
+	reader *bufio.Reader
+	// The offset of the next line.
+	offset int64
+}
+
+// Returns a reader for the operations in r, which must be positioned at the
+// start of the file.
+func newLegacyReader(r io.Reader) *legacyReader {
+	return &legacyReader{reader: bufio.NewReader(r)}
+}
+
+// Returns the next operation. Returns io.EOF when there are no more, a
+// *tornRecordError if the final line was never finished, or an error wrapping
+// ErrCorrupt if a line cannot be decoded.
+func (lr *legacyReader) next() (op marshalledOperation, err error) {
+	for {
+		line, err := lr.reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) == 0 {
+				return op, io.EOF
+			}
+			// Every line was written with its newline, so this one is incomplete.
+			return op, &tornRecordError{lr.offset, "incomplete line"}
+		} else if err != nil {
+			return op, err
+		}
+		offset := lr.offset
+		lr.offset += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		err = json.Unmarshal(line, &op)
+		if err != nil {
+			return op, fmt.Errorf("%w: undecodable line at offset %d: %v", ErrCorrupt, offset, err)
+		}
+		return op, nil
+	}
+}
@@ -0,0 +1,413 @@
+package persisted
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithSegments stores the log in a directory, at the log's path, as a series
+// of numbered segment files. Once the segment being appended to reaches
+// maxSize bytes, it is sealed and appends move on to a new segment.
+//
+// Compaction seals the current segment and writes the operations returned by
+// the SnapshotFunc to a snapshot file, numbered after the last segment it
+// includes, in the background. Once the snapshot is written, it and the
+// segments after it make up the log, and the segments it includes are removed
+// whole. Replay applies the latest snapshot and then the segments after it, in
+// order.
+//
+// WithSegments cannot be combined with WithSnapshots.
+func WithSegments(maxSize int64) Option {
+	return func(o *options) {
+		o.segmentSize = maxSize
+	}
+}
+
+const (
+	segmentSuffix         = ".segment"
+	segmentSnapshotSuffix = ".snapshot"
+)
+
+// Segment and snapshot files are named with their number, padded so that they
+// sort in order.
+func segmentName(n uint64, suffix string) string {
+	return fmt.Sprintf("%020d%s", n, suffix)
+}
+
+// Returns the numbers of the snapshots and segments in dir, in ascending
+// order.
+func listSegments(dir string) (snapshots, segments []uint64, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		for suffix, numbers := range map[string]*[]uint64{
+			segmentSuffix:         &segments,
+			segmentSnapshotSuffix: &snapshots,
+		} {
+			if !strings.HasSuffix(name, suffix) || strings.HasPrefix(name, ".") {
+				continue
+			}
+			n, err := strconv.ParseUint(strings.TrimSuffix(name, suffix), 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Unexpected file %s in log directory %s", name, dir)
+			}
+			*numbers = append(*numbers, n)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return snapshots, segments, nil
+}
+
+// Opens the last segment in dir, which is the one appended to, creating the
+// directory and a first segment if need be. Returns the segment's number.
+func openSegments(dir string, options *options) (*os.File, fileHeader, uint64, error) {
+	if !options.readOnly {
+		err := os.Mkdir(dir, 0755)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return nil, fileHeader{}, 0, err
+		}
+		err = removeSegmentTempFiles(dir)
+		if err != nil {
+			return nil, fileHeader{}, 0, err
+		}
+	}
+	snapshots, segments, err := listSegments(dir)
+	if err != nil {
+		return nil, fileHeader{}, 0, err
+	}
+	var n uint64
+	if len(segments) > 0 {
+		n = segments[len(segments)-1]
+	} else if options.readOnly {
+		return nil, fileHeader{}, 0, fmt.Errorf("No segments in log directory %s", dir)
+	} else {
+		// Start after the latest snapshot, if there is one.
+		if len(snapshots) > 0 {
+			n = snapshots[len(snapshots)-1]
+		}
+		n++
+		header := newFileHeader(options, time.Now())
+		header.Generation = n
+		err = createSegment(dir, n, header)
+		if err != nil {
+			return nil, fileHeader{}, 0, err
+		}
+	}
+
+	flag := os.O_RDWR
+	if options.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(n, segmentSuffix)), flag, 0)
+	if err != nil {
+		return nil, fileHeader{}, 0, err
+	}
+	header, err := readHeader(f)
+	if err == nil {
+		err = header.check(options)
+	}
+	if err == nil && header.Generation != n {
+		err = fmt.Errorf("%w: segment %d has generation %d", ErrCorrupt, n, header.Generation)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fileHeader{}, 0, err
+	}
+	return f, header, n, nil
+}
+
+// Atomically creates segment n in dir, holding just the header. Segments are
+// created whole so that a crash never leaves one without a header.
+func createSegment(dir string, n uint64, header fileHeader) error {
+	return writeFileAtomic(filepath.Join(dir, segmentName(n, segmentSuffix)), 0644, func(f *os.File) error {
+		return header.write(f)
+	})
+}
+
+// Removes temporary files left in dir by an interrupted write.
+func removeSegmentTempFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp-") {
+			err = os.Remove(filepath.Join(dir, name))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Replays the latest snapshot followed by the segments after it. l.mu must be
+// held.
+func (l *Log) replaySegments(handlers map[string]Handler) error {
+	err := l.waitForSnapshot()
+	if err != nil {
+		return err
+	}
+	snapshots, segments, err := listSegments(l.dir)
+	if err != nil {
+		return err
+	}
+	// The number of the last segment included in the snapshot.
+	var (
+		base         uint64
+		snapshotSize int64
+	)
+	if len(snapshots) > 0 {
+		base = snapshots[len(snapshots)-1]
+		snapshotFile, header, err := l.openPart(filepath.Join(l.dir, segmentName(base, segmentSnapshotSuffix)))
+		if err != nil {
+			return err
+		}
+		if snapshotFile == nil {
+			// Removed by the writer since we listed the directory.
+			return fmt.Errorf("Snapshot %d disappeared during replay", base)
+		}
+		snapshotSize, err = fileSize(snapshotFile)
+		if err == nil {
+			var torn *tornRecordError
+			_, torn, err = l.replayFile(snapshotFile, header, handlers)
+			if err == nil && torn != nil {
+				// Snapshots are written atomically, so this was not an interrupted write.
+				err = fmt.Errorf("%w: snapshot %d: %v", ErrCorrupt, base, torn)
+			}
+		}
+		snapshotFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	l.sealedSize = 0
+	next := base + 1
+	for _, n := range segments {
+		if n <= base {
+			// Left behind by a crash before they could be removed.
+			l.logger.Warn("segment left behind by an interrupted compaction", "segment", n)
+			continue
+		}
+		if n != next {
+			return fmt.Errorf("%w: missing segment %d", ErrCorrupt, next)
+		}
+		next++
+		if n == l.segment {
+			break
+		}
+		size, err := l.replaySealedSegment(n, handlers)
+		if err != nil {
+			return err
+		}
+		l.sealedSize += size
+	}
+	if next-1 != l.segment {
+		return fmt.Errorf("%w: missing segment %d", ErrCorrupt, next)
+	}
+	encoding, torn, err := l.replayFile(l.file, l.header, handlers)
+	if err != nil {
+		return err
+	}
+	l.encoding = encoding
+	if l.readOnly {
+		return nil
+	}
+	if torn != nil {
+		err = l.truncate(l.file, torn.offset)
+		if err != nil {
+			return err
+		}
+	}
+	err = l.removeSegments(segments, snapshots, base)
+	if err != nil {
+		return err
+	}
+	l.compacted(snapshotSize)
+	if l.migrated {
+		// Rewrite the log at the current schema version.
+		return l.compactSegments(true)
+	}
+	return nil
+}
+
+// Replays a segment other than the last, returning its size. l.mu must be
+// held.
+func (l *Log) replaySealedSegment(n uint64, handlers map[string]Handler) (int64, error) {
+	f, header, err := l.openPart(filepath.Join(l.dir, segmentName(n, segmentSuffix)))
+	if err != nil {
+		return 0, err
+	}
+	if f == nil {
+		return 0, fmt.Errorf("Segment %d disappeared during replay", n)
+	}
+	defer f.Close()
+	if header.Generation != n {
+		return 0, fmt.Errorf("%w: segment %d has generation %d", ErrCorrupt, n, header.Generation)
+	}
+	_, torn, err := l.replayFile(f, header, handlers)
+	if err != nil {
+		return 0, err
+	}
+	if torn != nil {
+		// Segments are only sealed after a complete write.
+		return 0, fmt.Errorf("%w: segment %d: %v", ErrCorrupt, n, torn)
+	}
+	return fileSize(f)
+}
+
+// Removes the segments, and the snapshots other than base, in the given lists
+// which are no longer part of the log. This only touches the directory, so
+// l.mu need not be held.
+func (l *Log) removeSegments(segments, snapshots []uint64, base uint64) error {
+	for _, n := range segments {
+		if n > base {
+			continue
+		}
+		err := os.Remove(filepath.Join(l.dir, segmentName(n, segmentSuffix)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, n := range snapshots {
+		if n >= base {
+			continue
+		}
+		err := os.Remove(filepath.Join(l.dir, segmentName(n, segmentSnapshotSuffix)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return syncDir(l.dir)
+}
+
+// Seals the current segment if it has reached the maximum size. l.mu must be
+// held.
+func (l *Log) rollIfNecessary() error {
+	stat, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < l.segmentSize {
+		return nil
+	}
+	return l.roll()
+}
+
+// Seals the current segment and starts appending to a new one. l.mu must be
+// held.
+func (l *Log) roll() error {
+	// Later syncs only cover the new segment.
+	err := l.syncLocked()
+	if err != nil {
+		return err
+	}
+	size, err := fileSize(l.file)
+	if err != nil {
+		return err
+	}
+	n := l.segment + 1
+	header := l.newHeader(n)
+	err = createSegment(l.dir, n, header)
+	if err != nil {
+		return err
+	}
+	newFile, err := os.OpenFile(filepath.Join(l.dir, segmentName(n, segmentSuffix)), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	header.size, err = newFile.Seek(0, 2)
+	if err != nil {
+		newFile.Close()
+		return err
+	}
+	l.file.Close()
+	l.file = newFile
+	l.header = header
+	l.encoding = newRecordEncoding(header.Format)
+	l.segment = n
+	l.sealedSize += size
+	l.logger.Debug("segment sealed", "segment", n-1, "size", size)
+	return nil
+}
+
+// Seals the current segment and writes a snapshot including it, after which
+// the segments it includes are removed. Unless wait is set, the snapshot is
+// written in the background, and if a snapshot is already being written this
+// does nothing. l.mu must be held.
+func (l *Log) compactSegments(wait bool) error {
+	if wait {
+		// This snapshot supersedes any being written in the background, so an error
+		// from that one doesn't matter.
+		l.waitForSnapshot()
+	} else if l.pending != nil {
+		select {
+		case <-l.pending.done:
+			// Should it have failed, this one takes its place.
+			l.waitForSnapshot()
+		default:
+			return nil
+		}
+	}
+	start := l.compactionStarted(!wait)
+	ops := l.liveOperations()
+	base := l.segment
+	err := l.roll()
+	if err != nil {
+		l.compactionFinished(start, err)
+		return err
+	}
+	header := l.newHeader(base)
+	covered := l.sealedSize
+	write := func() (int64, error) {
+		path := filepath.Join(l.dir, segmentName(base, segmentSnapshotSuffix))
+		var size int64
+		err := writeFileAtomic(path, 0644, func(f *os.File) error {
+			_, err := l.writeOperations(f, &header, ops)
+			if err != nil {
+				return err
+			}
+			size, err = f.Seek(0, 1)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		snapshots, segments, err := listSegments(l.dir)
+		if err == nil {
+			err = l.removeSegments(segments, snapshots, base)
+		}
+		return size, err
+	}
+
+	if wait {
+		size, err := write()
+		if err == nil {
+			l.sealedSize -= covered
+			l.compacted(size)
+		}
+		l.compactionFinished(start, err)
+		return err
+	}
+	// The live size is updated once the snapshot is written.
+	l.compacted(l.liveSize)
+	pending := &pendingSnapshot{done: make(chan struct{}), covered: covered, started: start}
+	l.pending = pending
+	go func() {
+		defer close(pending.done)
+		pending.size, pending.err = write()
+	}()
+	return nil
+}
@@ -0,0 +1,151 @@
+package persisted
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns the numbers of the snapshots and segments in a segmented log.
+func segmentFiles(t *testing.T, dir string) (snapshots, segments []uint64) {
+	snapshots, segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshots, segments
+}
+
+func checkIntegers(t *testing.T, ll *LinkedList[integer], n int) {
+	if ll.Length() != n {
+		t.Fatalf("Expected %d elements; got %d", n, ll.Length())
+	}
+	for i := 0; i < n; i++ {
+		if got, _ := ll.Get(i); got.WrappedInt != i {
+			t.Fatalf("Expected %d at position %d; got %d", i, i, got.WrappedInt)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "log")
+	ll, err := NewLinkedList[integer](dir, WithSegments(1024), WithCompactionPolicy(CompactManually))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		err = ll.Append(integer{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, segments := segmentFiles(t, dir)
+	if len(snapshots) != 0 || len(segments) < 3 {
+		t.Fatalf("Expected several segments and no snapshots; found segments %v and snapshots %v", segments, snapshots)
+	}
+	for i, n := range segments {
+		if n != uint64(i+1) {
+			t.Fatalf("Expected segments numbered from 1; found %v", segments)
+		}
+	}
+
+	ll, err = NewLinkedList[integer](dir, WithSegments(1024), WithCompactionPolicy(CompactManually))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIntegers(t, ll, 200)
+	// Compaction should replace every segment with a snapshot.
+	last := segments[len(segments)-1]
+	err = ll.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, segments = segmentFiles(t, dir)
+	if len(snapshots) != 1 || snapshots[0] != last || len(segments) != 1 || segments[0] != last+1 {
+		t.Fatalf("Expected snapshot %d and segment %d; found snapshots %v and segments %v",
+			last, last+1, snapshots, segments)
+	}
+	err = ll.Append(integer{200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ll, err = NewLinkedList[integer](dir, WithSegments(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ll.Close()
+	checkIntegers(t, ll, 201)
+}
+
+func TestSegmentsBackgroundCompaction(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "log")
+	ll, err := NewLinkedList[integer](dir, WithSegments(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		err = ll.Append(integer{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, _ := segmentFiles(t, dir)
+	if len(snapshots) != 1 {
+		t.Fatalf("Expected exactly one snapshot; found %v", snapshots)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name()[0] == '.' {
+			t.Fatalf("Temporary file %s left behind", entry.Name())
+		}
+	}
+
+	ll, err = NewLinkedList[integer](dir, WithSegments(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ll.Close()
+	checkIntegers(t, ll, 2000)
+}
+
+func TestMissingSegment(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "log")
+	ll, err := NewLinkedList[integer](dir, WithSegments(1024), WithCompactionPolicy(CompactManually))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		err = ll.Append(integer{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(dir, segmentName(2, segmentSuffix)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewLinkedList[integer](dir, WithSegments(1024))
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt with a segment missing; got %v", err)
+	}
+}
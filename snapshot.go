@@ -0,0 +1,354 @@
+package persisted
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WithSnapshots stores the log as a snapshot plus a tail instead of a single
+// file. Operations are appended to the tail, which lives at the log's path.
+// Compaction starts a new, empty tail and writes the operations returned by the
+// SnapshotFunc to a snapshot file, the log's path with ".snapshot" appended,
+// in the background, so that Append is not blocked while the structure is
+// written out. Replay applies the snapshot and then the tail.
+//
+// While a snapshot is being written, the tail it replaces is kept alongside
+// with ".prev" appended to the log's path, so that a crash at any point leaves
+// a complete log. Each file records a generation in its header which tells
+// Replay which tails the snapshot already includes.
+func WithSnapshots() Option {
+	return func(o *options) {
+		o.snapshots = true
+	}
+}
+
+func snapshotPath(path string) string {
+	return path + ".snapshot"
+}
+
+func previousTailPath(path string) string {
+	return path + ".prev"
+}
+
+// A snapshot being written in the background. size and err are set before done
+// is closed.
+type pendingSnapshot struct {
+	done chan struct{}
+	size int64
+	err  error
+	// The size of the sealed segments the snapshot includes, which are removed
+	// once it is written.
+	covered int64
+	started time.Time
+}
+
+// Tidies up after a compaction interrupted by a crash. If the crash came
+// between moving the tail aside and creating the new one, the previous tail is
+// moved back.
+func recoverSnapshotFiles(path string, logger *slog.Logger) error {
+	err := removeTempFiles(snapshotPath(path))
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Rename(previousTailPath(path), path)
+	if os.IsNotExist(err) {
+		// Neither exists; opening the tail will report this.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	logger.Warn("restored tail moved aside by an interrupted compaction")
+	return syncDir(filepath.Dir(path))
+}
+
+// Opens one of the files making up the log besides the tail. Returns a nil
+// file if it does not exist.
+func (l *Log) openPart(path string) (*os.File, fileHeader, error) {
+	flag := os.O_RDWR
+	if l.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if os.IsNotExist(err) {
+		return nil, fileHeader{}, nil
+	} else if err != nil {
+		return nil, fileHeader{}, err
+	}
+	header, err := readHeader(f)
+	if err == nil {
+		err = header.check(l.options)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fileHeader{}, err
+	}
+	return f, header, nil
+}
+
+// Replays the snapshot followed by the tails which it does not include. l.mu
+// must be held.
+func (l *Log) replaySnapshots(handlers map[string]Handler) error {
+	err := l.waitForSnapshot()
+	if err != nil {
+		return err
+	}
+	path := l.file.Name()
+	snapshotFile, snapshotHeader, err := l.openPart(snapshotPath(path))
+	if err != nil {
+		return err
+	}
+	// The generation of the next tail to apply. Tails from earlier generations
+	// are included in the snapshot.
+	var (
+		next         uint64
+		snapshotSize int64
+	)
+	if snapshotFile != nil {
+		snapshotSize, err = fileSize(snapshotFile)
+		if err != nil {
+			snapshotFile.Close()
+			return err
+		}
+		_, torn, err := l.replayFile(snapshotFile, snapshotHeader, handlers)
+		snapshotFile.Close()
+		if err != nil {
+			return err
+		}
+		if torn != nil {
+			// Snapshots are written atomically, so this was not an interrupted write.
+			return fmt.Errorf("%w: snapshot: %v", ErrCorrupt, torn)
+		}
+		next = snapshotHeader.Generation
+	}
+
+	prevFile, prevHeader, err := l.openPart(previousTailPath(path))
+	if err != nil {
+		return err
+	}
+	if prevFile != nil {
+		if prevHeader.Generation >= next {
+			_, err = l.replayTail(prevFile, prevHeader, handlers, next)
+			next++
+		}
+		prevFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	stale := l.header.Generation < next
+	if !stale {
+		encoding, err := l.replayTail(l.file, l.header, handlers, next)
+		if err != nil {
+			return err
+		}
+		l.encoding = encoding
+	}
+	if l.readOnly {
+		return nil
+	}
+	if l.header.legacy() {
+		err = l.convert()
+		if err != nil {
+			return err
+		}
+	}
+	// Finish whatever compaction was interrupted, or rewrite the log at the
+	// current schema version.
+	if prevFile != nil || stale {
+		l.logger.Warn("finishing interrupted compaction")
+	}
+	if prevFile != nil || stale || l.migrated {
+		return l.checkpoint()
+	}
+	l.compacted(snapshotSize)
+	return nil
+}
+
+// Replays a tail, which must have the given generation. l.mu must be held.
+func (l *Log) replayTail(f *os.File, header fileHeader, handlers map[string]Handler, generation uint64) (recordEncoding, error) {
+	if header.Generation != generation {
+		return nil, fmt.Errorf("%w: expected generation %d in %s; found %d",
+			ErrCorrupt, generation, f.Name(), header.Generation)
+	}
+	encoding, torn, err := l.replayFile(f, header, handlers)
+	if err != nil {
+		return nil, err
+	}
+	if torn != nil && !l.readOnly {
+		err = l.truncate(f, torn.offset)
+	}
+	return encoding, err
+}
+
+// Writes a snapshot of the current state and starts a new, empty tail, all
+// before returning. l.mu must be held.
+func (l *Log) checkpoint() error {
+	// This snapshot supersedes any being written in the background, so an error
+	// from that one doesn't matter.
+	l.waitForSnapshot()
+	start := l.compactionStarted(false)
+	err := l.writeCheckpoint()
+	l.compactionFinished(start, err)
+	return err
+}
+
+// Does the work of checkpoint. l.mu must be held.
+func (l *Log) writeCheckpoint() error {
+	path := l.file.Name()
+	generation := l.header.Generation + 1
+	size, err := l.writeSnapshot(path, l.newHeader(generation), l.liveOperations())
+	if err != nil {
+		return err
+	}
+	// The snapshot now includes the tail, so from here on a crash leaves a stale
+	// tail which replay ignores.
+	header := l.newHeader(generation)
+	var encoding recordEncoding
+	err = replaceFile(path, func(f *os.File) (err error) {
+		encoding, err = l.writeOperations(f, &header, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = l.reopen(header, encoding)
+	if err != nil {
+		return err
+	}
+	l.compacted(size)
+	return removeFile(previousTailPath(path))
+}
+
+// Moves the tail aside, starts a new one and writes a snapshot in the
+// background. Once the snapshot is written the previous tail is removed. If a
+// snapshot is already being written this does nothing. Failures are logged and
+// counted by compactionFinished. l.mu must be held.
+func (l *Log) rotate() error {
+	if l.pending != nil {
+		select {
+		case <-l.pending.done:
+			// Should it have failed, the previous tail is still there, and is dealt
+			// with below.
+			l.waitForSnapshot()
+		default:
+			return nil
+		}
+	}
+	path := l.file.Name()
+	prev := previousTailPath(path)
+	if _, err := os.Stat(prev); !os.IsNotExist(err) {
+		// An earlier snapshot failed, so the previous tail may still be needed.
+		return l.checkpoint()
+	}
+
+	start := l.compactionStarted(true)
+	info, err := l.file.Stat()
+	if err == nil {
+		// The tail being moved aside must be durable until the snapshot is.
+		err = l.file.Sync()
+	}
+	if err != nil {
+		l.compactionFinished(start, err)
+		return err
+	}
+	ops := l.liveOperations()
+	generation := l.header.Generation + 1
+	// The live size is updated once the snapshot is written.
+	l.compacted(l.liveSize)
+	err = os.Rename(path, prev)
+	if err != nil {
+		l.compactionFinished(start, err)
+		return err
+	}
+	header := l.newHeader(generation)
+	var encoding recordEncoding
+	err = writeFileAtomic(path, info.Mode().Perm(), func(f *os.File) (err error) {
+		encoding, err = l.writeOperations(f, &header, nil)
+		return err
+	})
+	if err == nil {
+		err = l.reopen(header, encoding)
+	}
+	if err != nil {
+		os.Rename(prev, path)
+		l.compactionFinished(start, err)
+		return err
+	}
+
+	pending := &pendingSnapshot{done: make(chan struct{}), started: start}
+	l.pending = pending
+	snapshotHeader := l.newHeader(generation)
+	go func() {
+		defer close(pending.done)
+		pending.size, pending.err = l.writeSnapshot(path, snapshotHeader, ops)
+		if pending.err == nil {
+			pending.err = removeFile(prev)
+		}
+	}()
+	return nil
+}
+
+// Atomically writes the snapshot of the log at path, returning its size. This
+// does not touch the log's state, so l.mu need not be held.
+func (l *Log) writeSnapshot(path string, header fileHeader, ops []Operation) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	err = writeFileAtomic(snapshotPath(path), info.Mode().Perm(), func(f *os.File) error {
+		_, err := l.writeOperations(f, &header, ops)
+		if err != nil {
+			return err
+		}
+		size, err = f.Seek(0, 1)
+		return err
+	})
+	return size, err
+}
+
+// Waits for the snapshot being written in the background, if any, and returns
+// the error from writing it. l.mu must be held.
+func (l *Log) waitForSnapshot() error {
+	if l.pending == nil {
+		return nil
+	}
+	<-l.pending.done
+	pending := l.pending
+	l.pending = nil
+	if pending.err != nil {
+		l.compactionFinished(pending.started, pending.err)
+		return pending.err
+	}
+	l.liveSize = pending.size
+	l.sealedSize -= pending.covered
+	l.compactionFinished(pending.started, nil)
+	return nil
+}
+
+// Removes the file at path, if it exists, and makes the removal durable.
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func fileSize(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
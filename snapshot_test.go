@@ -0,0 +1,174 @@
+package persisted
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSnapshots(t *testing.T) {
+	tf, err := ioutil.TempFile("", "temp-testing")
+	defer removeLogFiles(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll, err := NewLinkedList[integer](tf.Name(), WithSnapshots())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough to pass the compaction threshold several times, although how many
+	// compactions happen depends on how quickly snapshots are written.
+	for i := 0; i < 2000; i++ {
+		err = ll.Append(integer{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	generation := ll.log.header.Generation
+	if generation == 0 {
+		t.Fatal("Expected the log to have been compacted")
+	}
+	err = ll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(snapshotPath(tf.Name())); err != nil {
+		t.Fatalf("Expected a snapshot file: %v", err)
+	}
+	if _, err := os.Stat(previousTailPath(tf.Name())); !os.IsNotExist(err) {
+		t.Fatalf("Expected the previous tail to have been removed: %v", err)
+	}
+
+	ll, err = NewLinkedList[integer](tf.Name(), WithSnapshots())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ll.Close()
+	if ll.Length() != 2000 {
+		t.Fatalf("Expected 2000 elements after replay; got %d", ll.Length())
+	}
+	for i := 0; i < 2000; i++ {
+		if got, _ := ll.Get(i); got.WrappedInt != i {
+			t.Fatalf("Expected %d at position %d; got %d", i, i, got.WrappedInt)
+		}
+	}
+	// Replay doesn't compact unless it has to.
+	if ll.log.header.Generation != generation {
+		t.Fatalf("Generation changed from %d to %d on replay", generation, ll.log.header.Generation)
+	}
+}
+
+// A crash part-way through compaction should always leave a complete log.
+func TestInterruptedSnapshot(t *testing.T) {
+	tf, err := ioutil.TempFile("", "temp-testing")
+	defer removeLogFiles(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := tf.Name()
+	var s []int
+	callback := func() []Operation {
+		ops := make([]Operation, len(s))
+		for index, i := range s {
+			ops[index] = NewOperation(appendKey, i)
+		}
+		return ops
+	}
+	l, err := NewLog(path, callback, WithSnapshots())
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendInts := func(from, to int) {
+		for i := from; i < to; i++ {
+			s = append(s, i)
+			err := l.Append(appendKey, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	readFile := func(path string) []byte {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+
+	// Write the files as they are before and after compaction.
+	appendInts(0, 10)
+	l.mu.Lock()
+	err = l.checkpoint()
+	l.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendInts(10, 20)
+	oldSnapshot, oldTail := readFile(snapshotPath(path)), readFile(path)
+	l.mu.Lock()
+	err = l.rotate()
+	if err == nil {
+		err = l.waitForSnapshot()
+	}
+	l.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendInts(20, 30)
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSnapshot, newTail := readFile(snapshotPath(path)), readFile(path)
+
+	tests := []struct {
+		name                 string
+		snapshot, prev, tail []byte
+		expected             int
+	}{
+		{"before snapshot written", oldSnapshot, oldTail, newTail, 30},
+		{"before previous tail removed", newSnapshot, oldTail, newTail, 30},
+		{"before new tail created", oldSnapshot, oldTail, nil, 20},
+		{"before checkpoint tail replaced", newSnapshot, nil, oldTail, 20},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			files := map[string][]byte{
+				snapshotPath(path):     tc.snapshot,
+				previousTailPath(path): tc.prev,
+				path:                   tc.tail,
+			}
+			for name, contents := range files {
+				os.Remove(name)
+				if contents != nil {
+					err := os.WriteFile(name, contents, 0644)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			var replayed []int
+			l, err := NewLog(path, func() []Operation {
+				ops := make([]Operation, len(replayed))
+				for index, i := range replayed {
+					ops[index] = NewOperation(appendKey, i)
+				}
+				return ops
+			}, WithSnapshots())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			err = l.Replay(map[string]Handler{appendKey: appendOperation(&replayed)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slicesEqual(replayed, s[:tc.expected]) {
+				t.Fatalf("Replayed %v", replayed)
+			}
+			if _, err := os.Stat(previousTailPath(path)); !os.IsNotExist(err) {
+				t.Fatalf("Expected replay to remove the previous tail: %v", err)
+			}
+		})
+	}
+}
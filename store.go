@@ -0,0 +1,250 @@
+package persisted
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store hosts any number of named structures (LinkedLists, Maps and Queues)
+// over a single shared log, so that Update can change several of them
+// atomically. Initialize a Store by calling OpenStore, then open the structures
+// in it with OpenList, OpenMap and OpenQueue.
+//
+// Each structure records its operations in the Store's log under its name. The
+// state of a structure which has not been opened is carried over as it is, so a
+// program need not open every structure in the Store.
+//
+// A Store is safe for concurrent use. Its structures share a single lock, so
+// changes to any of them are serialized.
+type Store struct {
+	// Guards everything below, and the state of every structure opened from the
+	// Store.
+	mu  sync.RWMutex
+	log *Log
+	// The structures which have been opened, by name.
+	structures map[string]storeStructure
+	// The operations replayed for structures which have not been opened yet, by
+	// name.
+	unopened map[string][]marshalledOperation
+}
+
+// A structure opened from a Store.
+type storeStructure struct {
+	structure interface{}
+	snapshot  SnapshotFunc
+}
+
+// StoreTx is a transaction on a Store, passed to the function given to Update.
+// The structures taking part are reached through their In methods.
+type StoreTx struct {
+	store *Store
+	t     *transaction
+}
+
+// Separates the name of a structure from the key of an operation in the
+// Store's log.
+const storeKeySeparator = "/"
+
+// OpenStore returns a Store backed by the log at the specified path, which is
+// a single file or, with WithSegments, a directory. If the log exists it is
+// replayed, otherwise it is created as for NewLog.
+//
+// The options configure the underlying log.
+func OpenStore(path string, opts ...Option) (store *Store, err error) {
+	store = &Store{
+		structures: make(map[string]storeStructure),
+		unopened:   make(map[string][]marshalledOperation),
+	}
+	store.log, err = NewLog(path, store.getCallback(), append(opts, WithType("store"))...)
+	if err != nil {
+		return nil, err
+	}
+	// No structure is open yet, so every operation is put aside until its
+	// structure is.
+	store.log.route = store.route
+	err = store.log.Replay(nil)
+	if err != nil {
+		store.log.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// OpenList returns the LinkedList with the given name in the Store, which is
+// empty if the Store holds no such structure. Opening the same name again
+// returns the same list. A list opened from a Store shares the Store's log, so
+// its Sync, Compact and Close methods act on the whole Store.
+func OpenList[T any](s *Store, name string) (*LinkedList[T], error) {
+	return openInStore(s, name, func(prefix string) (*LinkedList[T], SnapshotFunc, map[string]Handler) {
+		ll := newLinkedList[T](&s.mu)
+		ll.log, ll.store, ll.prefix = s.log, s, prefix
+		return ll, ll.getCallback(), ll.getOperationsMap()
+	}, nil)
+}
+
+// OpenMap returns the Map with the given name in the Store, which is empty if
+// the Store holds no such structure. Opening the same name again returns the
+// same map. As with OpenList, the map shares the Store's log.
+func OpenMap[K comparable, V any](s *Store, name string) (*Map[K, V], error) {
+	return openInStore(s, name, func(prefix string) (*Map[K, V], SnapshotFunc, map[string]Handler) {
+		m := newMap[K, V](&s.mu)
+		m.log, m.store, m.prefix = s.log, s, prefix
+		return m, m.getCallback(), m.getOperationsMap()
+	}, nil)
+}
+
+// OpenQueue returns the Queue with the given name in the Store, which is empty
+// if the Store holds no such structure. When the queue is first opened, any
+// elements which were in flight are redelivered, as for NewQueue. Opening the
+// same name again returns the same queue. As with OpenList, the queue shares
+// the Store's log.
+func OpenQueue[T any](s *Store, name string) (*Queue[T], error) {
+	return openInStore(s, name, func(prefix string) (*Queue[T], SnapshotFunc, map[string]Handler) {
+		q := newQueue[T](&s.mu)
+		q.log, q.store, q.prefix = s.log, s, prefix
+		return q, q.getCallback(), q.getOperationsMap()
+	}, (*Queue[T]).redeliver)
+}
+
+// Returns the structure with the given name, creating it and applying the
+// operations put aside for it if it has not been opened before. loaded, if not
+// nil, is called with s.mu held once a new structure has been rebuilt.
+func openInStore[S any](
+	s *Store, name string,
+	create func(prefix string) (S, SnapshotFunc, map[string]Handler),
+	loaded func(S) error,
+) (S, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var zero S
+	if name == "" {
+		return zero, errors.New("Structure name must not be empty")
+	}
+	if open, ok := s.structures[name]; ok {
+		structure, ok := open.structure.(S)
+		if !ok {
+			return zero, fmt.Errorf("Structure %q is already open as a %T", name, open.structure)
+		}
+		return structure, nil
+	}
+	structure, snapshot, handlers := create(name + storeKeySeparator)
+	for _, marshalledOp := range s.unopened[name] {
+		handler, keyExists := handlers[marshalledOp.Key]
+		if !keyExists {
+			return zero, fmt.Errorf("Key <%s> found in log file but not operations map of structure %q",
+				marshalledOp.Key, name)
+		}
+		err := handler(marshalledOp.params(s.log.codec))
+		if err != nil {
+			return zero, fmt.Errorf("Error applying operation to structure %q: %w", name, err)
+		}
+	}
+	delete(s.unopened, name)
+	s.structures[name] = storeStructure{structure, snapshot}
+	if loaded != nil {
+		err := loaded(structure)
+		if err != nil {
+			return zero, err
+		}
+	}
+	return structure, nil
+}
+
+// Update calls fn with a transaction through which it can modify any of the
+// Store's structures. The changes fn makes are recorded in the log as a single
+// record once it returns, so replay applies either all of them or none. If fn
+// returns an error or panics, or the changes cannot be recorded, they are
+// rolled back and every structure is left as it was.
+//
+// The Store is locked while fn runs, so fn must only use the Store's
+// structures through tx. tx must not be used once fn has returned.
+func (s *Store) Update(fn func(tx *StoreTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.log.checkWritable(); err != nil {
+		return err
+	}
+	tx := &StoreTx{store: s, t: new(transaction)}
+	return tx.t.run(s.log, func() error { return fn(tx) })
+}
+
+// Panics unless a structure opened from the given Store may take part in the
+// transaction.
+func (tx *StoreTx) check(store *Store) {
+	if store != tx.store {
+		panic("persisted: structure is not part of the transaction's Store")
+	}
+}
+
+// Sync flushes every change made to the Store's structures so far to stable
+// storage, regardless of the SyncPolicy the Store was opened with.
+func (s *Store) Sync() error {
+	return s.log.Sync()
+}
+
+// Compact compacts the Store's log now, whatever the CompactionPolicy it was
+// opened with.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Compact()
+}
+
+// Close flushes the Store to stable storage and releases its log. The Store's
+// structures can still be read after it is closed, but any attempt to modify
+// them returns ErrClosed.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+// Puts aside a replayed operation for the structure it belongs to. Called
+// during Replay, before any structure is open.
+func (s *Store) route(marshalledOp marshalledOperation) (bool, error) {
+	separator := strings.LastIndex(marshalledOp.Key, storeKeySeparator)
+	if separator <= 0 {
+		return false, nil
+	}
+	name := marshalledOp.Key[:separator]
+	marshalledOp.Key = marshalledOp.Key[separator+len(storeKeySeparator):]
+	s.unopened[name] = append(s.unopened[name], marshalledOp)
+	return true, nil
+}
+
+// Returns a callback function for the Store which can be passed into the
+// NewLog function. It combines the snapshots of the open structures with the
+// operations put aside for the others, each under its structure's name. As
+// with LinkedList, the callback runs with s.mu already held and must not lock.
+func (s *Store) getCallback() SnapshotFunc {
+	return func() []Operation {
+		names := make([]string, 0, len(s.structures)+len(s.unopened))
+		for name := range s.structures {
+			names = append(names, name)
+		}
+		for name := range s.unopened {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var ops []Operation
+		for _, name := range names {
+			prefix := name + storeKeySeparator
+			if open, ok := s.structures[name]; ok {
+				for _, op := range open.snapshot() {
+					ops = append(ops, Operation{prefix + op.Key, op.Params})
+				}
+				continue
+			}
+			for _, marshalledOp := range s.unopened[name] {
+				op := marshalledOp.raw()
+				op.Key = prefix + op.Key
+				ops = append(ops, op)
+			}
+		}
+		return ops
+	}
+}
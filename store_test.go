@@ -0,0 +1,189 @@
+package persisted
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// The structures in the store used by the tests below.
+type testStore struct {
+	*Store
+	pending *LinkedList[int]
+	done    *LinkedList[int]
+	counts  *Map[string, int]
+	jobs    *Queue[int]
+}
+
+func openTestStore(t *testing.T, path string, opts ...Option) testStore {
+	s, err := OpenStore(path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := testStore{Store: s}
+	ts.pending, err = OpenList[int](s, "pending")
+	if err == nil {
+		ts.done, err = OpenList[int](s, "done")
+	}
+	if err == nil {
+		ts.counts, err = OpenMap[string, int](s, "counts")
+	}
+	if err == nil {
+		ts.jobs, err = OpenQueue[int](s, "jobs")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// Moves the last pending element to done and counts it.
+func (ts testStore) finish(tx *StoreTx) error {
+	n, err := ts.pending.In(tx).Pop()
+	if err != nil {
+		return err
+	}
+	err = ts.done.In(tx).Append(n)
+	if err != nil {
+		return err
+	}
+	count, _ := ts.counts.In(tx).Get("done")
+	return ts.counts.In(tx).Set("done", count+1)
+}
+
+func (ts testStore) check(t *testing.T, pending, done []int, count int) {
+	t.Helper()
+	if got := getIntegerSlice(ts.pending); !reflect.DeepEqual(got, pending) {
+		t.Fatalf("Expected pending %v; got %v", pending, got)
+	}
+	if got := getIntegerSlice(ts.done); !reflect.DeepEqual(got, done) {
+		t.Fatalf("Expected done %v; got %v", done, got)
+	}
+	if got, _ := ts.counts.Get("done"); got != count {
+		t.Fatalf("Expected count %d; got %d", count, got)
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := newLogFile(t)
+	ts := openTestStore(t, path)
+	for i := 0; i < 3; i++ {
+		err := ts.pending.Append(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ts.Update(ts.finish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.check(t, []int{0, 1}, []int{2}, 1)
+
+	// A failed update changes none of the structures.
+	errFailed := errors.New("failed")
+	err = ts.Update(func(tx *StoreTx) error {
+		if err := ts.finish(tx); err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("Expected the update's error; got %v", err)
+	}
+	ts.check(t, []int{0, 1}, []int{2}, 1)
+
+	// Dequeue a job in the same update as finishing an element.
+	err = ts.jobs.Enqueue(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.Update(func(tx *StoreTx) error {
+		lease, err := ts.jobs.In(tx).Dequeue()
+		if err != nil {
+			return err
+		}
+		if err := ts.pending.In(tx).Push(lease.Value); err != nil {
+			return err
+		}
+		return ts.finish(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.check(t, []int{7, 0}, []int{2, 1}, 2)
+	err = ts.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Structures which are not opened are kept through compaction.
+	s, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := OpenList[int](s, "done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = done.Append(3)
+	if err == nil {
+		err = s.Compact()
+	}
+	if err == nil {
+		err = s.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts = openTestStore(t, path)
+	defer ts.Close()
+	ts.check(t, []int{7, 0}, []int{2, 1, 3}, 2)
+	// The job was in flight, so it is redelivered.
+	if ts.jobs.Len() != 1 || ts.jobs.InFlight() != 0 {
+		t.Fatalf("Expected the dequeued job to be redelivered; queue has %d waiting and %d in flight",
+			ts.jobs.Len(), ts.jobs.InFlight())
+	}
+	_, err = OpenMap[string, int](ts.Store, "done")
+	if err == nil {
+		t.Fatal("Expected an error opening a list as a map")
+	}
+	again, err := OpenList[int](ts.Store, "done")
+	if err != nil || again != ts.done {
+		t.Fatalf("Expected the same list opening it again; got %v", err)
+	}
+}
+
+func TestTornStoreUpdate(t *testing.T) {
+	path := newLogFile(t)
+	opts := []Option{WithCompactionPolicy(CompactManually)}
+	ts := openTestStore(t, path, opts...)
+	for i := 0; i < 3; i++ {
+		err := ts.pending.Append(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sizeBefore := size(ts.log.file)
+	err := ts.Update(ts.finish)
+	if err == nil {
+		err = ts.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the update's record off partway through, as a crash mid-write would.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path, (sizeBefore+info.Size())/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = openTestStore(t, path, opts...)
+	defer ts.Close()
+	ts.check(t, []int{0, 1, 2}, []int{}, 0)
+}
@@ -0,0 +1,98 @@
+package persisted
+
+import (
+	"errors"
+	"fmt"
+)
+
+// UnknownOperationPolicy determines what Replay does with an operation whose
+// key has no Handler, such as one written by a newer version of a program
+// which has since been rolled back.
+type UnknownOperationPolicy struct {
+	skip     bool
+	fallback FallbackHandler
+}
+
+// FallbackHandler is called by Replay for each operation whose key has no
+// Handler. It receives the key and the operation's marshalled parameters.
+type FallbackHandler func(key string, params Params) error
+
+var (
+	// UnknownOperationsFail makes Replay return an error on meeting an operation
+	// it has no Handler for. This is the default.
+	UnknownOperationsFail = UnknownOperationPolicy{}
+	// UnknownOperationsSkip makes Replay skip operations it has no Handler for.
+	// The number skipped is reported by Skipped.
+	UnknownOperationsSkip = UnknownOperationPolicy{skip: true}
+)
+
+// UnknownOperationsFallback makes Replay hand operations it has no Handler for
+// to the given handler. An error from the handler stops the replay.
+func UnknownOperationsFallback(handler FallbackHandler) UnknownOperationPolicy {
+	return UnknownOperationPolicy{fallback: handler}
+}
+
+// WithUnknownOperations sets what Replay does with operations it has no Handler
+// for. The default is UnknownOperationsFail.
+//
+// Skipped operations, and those passed to a fallback handler, are not part of
+// the structure's state, so the SnapshotFunc does not return them. Compaction
+// keeps them anyway, writing them unchanged after the snapshot, so that a
+// program which does have Handlers for them can still replay them.
+func WithUnknownOperations(policy UnknownOperationPolicy) Option {
+	return func(o *options) {
+		o.unknown = policy
+	}
+}
+
+// Applies an operation which has no Handler according to the log's
+// UnknownOperationPolicy. l.mu must be held.
+func (l *Log) handleUnknown(marshalledOp marshalledOperation) error {
+	policy := l.options.unknown
+	switch {
+	case policy.fallback != nil:
+		l.skipped[marshalledOp.Key]++
+		l.unknown = append(l.unknown, marshalledOp)
+		err := policy.fallback(marshalledOp.Key, marshalledOp.params(l.codec))
+		if err != nil {
+			return fmt.Errorf("Error applying operation: %w", err)
+		}
+		return nil
+	case policy.skip:
+		l.skipped[marshalledOp.Key]++
+		l.unknown = append(l.unknown, marshalledOp)
+		return nil
+	default:
+		return errors.New("Key <" + marshalledOp.Key + "> found in log file but not operations map")
+	}
+}
+
+// Returns the operations to compact the log down to: those returned by the
+// SnapshotFunc, followed by those the last replay had no Handler for, passed
+// through untouched as Store does for structures which have not been opened.
+// l.mu must be held.
+func (l *Log) liveOperations() []Operation {
+	ops := l.snapshot()
+	if len(l.unknown) == 0 {
+		return ops
+	}
+	// Don't append to the SnapshotFunc's slice in place.
+	ops = ops[:len(ops):len(ops)]
+	for _, marshalledOp := range l.unknown {
+		ops = append(ops, marshalledOp.raw())
+	}
+	return ops
+}
+
+// Skipped returns the number of operations the last call to Replay had no
+// Handler for, by key. These were either skipped or handed to a fallback
+// handler, depending on the log's UnknownOperationPolicy.
+func (l *Log) Skipped() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	skipped := make(map[string]int, len(l.skipped))
+	for key, count := range l.skipped {
+		skipped[key] = count
+	}
+	return skipped
+}
@@ -0,0 +1,185 @@
+package persisted
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestUnknownOperations(t *testing.T) {
+	const newKey = "new operation"
+	tf, err := ioutil.TempFile("", "temp-testing")
+	defer removeLogFiles(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s []int
+	callback := func() []Operation {
+		ops := make([]Operation, len(s))
+		for index, i := range s {
+			ops[index] = NewOperation(appendKey, i)
+		}
+		return ops
+	}
+	l, err := NewLog(tf.Name(), callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = l.Append(appendKey, i)
+		if err == nil {
+			err = l.Append(newKey, i, "param")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizeBefore := size(tf)
+
+	replay := func(policy UnknownOperationPolicy) (*Log, error) {
+		s = nil
+		l, err := NewLog(tf.Name(), callback, WithUnknownOperations(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l, l.Replay(map[string]Handler{appendKey: appendOperation(&s)})
+	}
+
+	l, err = replay(UnknownOperationsFail)
+	if err == nil {
+		t.Fatal("Expected an error replaying an unknown operation")
+	}
+	l.Close()
+
+	l, err = replay(UnknownOperationsSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slicesEqual(s, []int{0, 1, 2}) {
+		t.Fatalf("Replayed %v", s)
+	}
+	if skipped := l.Skipped(); len(skipped) != 1 || skipped[newKey] != 3 {
+		t.Fatalf("Expected 3 operations skipped; got %v", skipped)
+	}
+	if size(l.file) != sizeBefore {
+		t.Fatal("Replay compacted away skipped operations")
+	}
+	l.Close()
+
+	var fallback []int
+	l, err = replay(UnknownOperationsFallback(func(key string, params Params) error {
+		if key != newKey {
+			t.Errorf("Fallback handler called with key %s", key)
+		}
+		if err := params.Expect(2); err != nil {
+			return err
+		}
+		var i int
+		err := json.Unmarshal(params.Raw(0), &i)
+		fallback = append(fallback, i)
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !slicesEqual(s, []int{0, 1, 2}) || !slicesEqual(fallback, []int{0, 1, 2}) {
+		t.Fatalf("Replayed %v and fell back on %v", s, fallback)
+	}
+	if l.Skipped()[newKey] != 3 {
+		t.Fatalf("Expected 3 operations reported; got %v", l.Skipped())
+	}
+}
+
+// Operations skipped by an older program should survive its compactions, so
+// that rolling forward again finds them.
+func TestUnknownOperationsSurviveCompaction(t *testing.T) {
+	const newKey = "new operation"
+	path := newLogFile(t)
+	var s []int
+	callback := func() []Operation {
+		ops := make([]Operation, len(s))
+		for index, i := range s {
+			ops[index] = NewOperation(appendKey, i)
+		}
+		return ops
+	}
+	l, err := NewLog(path, callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append(appendKey, 0)
+	if err == nil {
+		err = l.Append(newKey, 1, "param")
+	}
+	if err == nil {
+		err = l.Append(appendKey, 2)
+	}
+	if err == nil {
+		err = l.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The older program skips the new operation and compacts, both of its own
+	// accord and when asked to.
+	s = nil
+	l, err = NewLog(path, callback, WithUnknownOperations(UnknownOperationsSkip),
+		WithCompactionPolicy(CompactEvery(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Replay(map[string]Handler{appendKey: appendOperation(&s)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = append(s, 3)
+	err = l.Append(appendKey, 3)
+	if err == nil {
+		err = l.Compact()
+	}
+	if err == nil {
+		err = l.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = nil
+	var params []string
+	l, err = NewLog(path, callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	err = l.Replay(map[string]Handler{
+		appendKey: appendOperation(&s),
+		newKey: func(p Params) error {
+			var i int
+			var str string
+			if err := p.Decode(0, &i); err != nil {
+				return err
+			}
+			if err := p.Decode(1, &str); err != nil {
+				return err
+			}
+			params = append(params, fmt.Sprintf("%d %s", i, str))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slicesEqual(s, []int{0, 2, 3}) {
+		t.Fatalf("Replayed %v after compaction", s)
+	}
+	if len(params) != 1 || params[0] != "1 param" {
+		t.Fatalf("Expected the skipped operation to survive compaction; replayed %v", params)
+	}
+}